@@ -0,0 +1,335 @@
+package datafs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//ErrChunkNotExist is returned when a chunk is expected to be stored but isn't
+	ErrChunkNotExist = errors.New("No such chunk")
+)
+
+var (
+	//BucketNameChunkStats refers to the bucket that holds chunk store statistics
+	BucketNameChunkStats = []byte("chunkstats")
+
+	keyStatsChunks   = []byte("chunks")
+	keyStatsLogical  = []byte("logical")
+	keyStatsPhysical = []byte("physical")
+	keyGeneration    = []byte("generation")
+
+	keyVolumeHash = []byte("hash")
+)
+
+//chunkHeaderSize is the number of bytes in front of every stored chunk payload
+const chunkHeaderSize = 24
+
+//chunkHeader is stored in front of every chunk payload in the chunks bucket
+type chunkHeader struct {
+	Refs uint64 //number of times files reference the chunk
+	Size uint64 //number of (logical) content bytes in the chunk
+	Gen  uint64 //collector generation in which the chunk was last referenced
+}
+
+func decodeChunkRecord(k K, v []byte) (hdr chunkHeader, payload []byte, err error) {
+	if len(v) < chunkHeaderSize {
+		return hdr, nil, fmt.Errorf("chunk '%s' record is truncated", k)
+	}
+
+	hdr.Refs = binary.BigEndian.Uint64(v[0:])
+	hdr.Size = binary.BigEndian.Uint64(v[8:])
+	hdr.Gen = binary.BigEndian.Uint64(v[16:])
+	return hdr, v[chunkHeaderSize:], nil
+}
+
+func encodeChunkRecord(hdr chunkHeader, payload []byte) []byte {
+	v := make([]byte, chunkHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(v[0:], hdr.Refs)
+	binary.BigEndian.PutUint64(v[8:], hdr.Size)
+	binary.BigEndian.PutUint64(v[16:], hdr.Gen)
+	copy(v[chunkHeaderSize:], payload)
+	return v
+}
+
+//ChunkStats describes the de-duplication of the chunk store
+type ChunkStats struct {
+	Chunks        uint64 //number of unique chunks stored
+	LogicalBytes  uint64 //number of bytes as referenced by files
+	PhysicalBytes uint64 //number of bytes actually stored
+}
+
+//ChunkStore stores each unique chunk once in the chunks bucket and counts
+//how often files reference it, a chunk is removed as soon as nothing
+//references it anymore. All methods operate on a caller provided
+//transaction such that chunk references can be updated atomically with the
+//file metadata that holds them. Chunk payloads are encoded with the
+//configured codec and, for encrypted volumes, sealed afterwards.
+type ChunkStore struct {
+	hash   Hash
+	codec  Codec
+	cipher *chunkCipher
+}
+
+//NewChunkStore sets up the buckets the chunk store requires, if 'opts' is
+//nil the DefaultOptions are used. The hash algorithm that keys new chunks is
+//recorded in the volume metadata when the store is first created, the
+//configured Hash is used for that or SHA256 if it is zero. Volumes that hold
+//chunks from before the algorithm was recorded keep using SHA1. If the
+//volume is encrypted the configured Secret must match the one it was
+//created with.
+func NewChunkStore(db *bolt.DB, opts *Options) (s *ChunkStore, err error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+
+	h := opts.Hash
+	if h == 0 {
+		h = SHA256
+	}
+
+	if !h.Available() {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownHash, h)
+	}
+
+	if !opts.Compression.Available() {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownCodec, opts.Compression)
+	}
+
+	s = &ChunkStore{codec: opts.Compression}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{BucketNameVolume, BucketNameChunks, BucketNameChunkStats} {
+			if _, txerr := tx.CreateBucketIfNotExists(name); txerr != nil {
+				return fmt.Errorf("failed to create bucket '%s': %v", name, txerr)
+			}
+		}
+
+		var txerr error
+		s.cipher, txerr = setupEncryption(tx, opts.Secret)
+		if txerr != nil {
+			return txerr
+		}
+
+		vb := tx.Bucket(BucketNameVolume)
+		if v := vb.Get(keyVolumeHash); len(v) == 1 {
+			s.hash = Hash(v[0])
+			if !s.hash.Available() {
+				return fmt.Errorf("%v: volume uses %s", ErrUnknownHash, s.hash)
+			}
+
+			return nil
+		}
+
+		s.hash = h
+		if k, _ := tx.Bucket(BucketNameChunks).Cursor().First(); k != nil {
+			s.hash = SHA1 //existing volume with legacy keys
+		}
+
+		return vb.Put(keyVolumeHash, []byte{byte(s.hash)})
+	}); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+//Put stores the chunk if it isn't stored yet and adds a reference to it
+func (s *ChunkStore) Put(tx *bolt.Tx, c Chunk) (k K, err error) {
+	k = s.Key(c)
+	b := tx.Bucket(BucketNameChunks)
+	if v := b.Get(k[:]); v != nil {
+		return k, s.Ref(tx, k)
+	}
+
+	payload, err := s.codec.Encode(c)
+	if err != nil {
+		return k, err
+	}
+
+	if s.cipher != nil {
+		payload, err = s.cipher.seal(k, payload)
+		if err != nil {
+			return k, err
+		}
+	}
+
+	hdr := chunkHeader{Refs: 1, Size: uint64(len(c)), Gen: s.generation(tx)}
+	if err = b.Put(k[:], encodeChunkRecord(hdr, payload)); err != nil {
+		return k, fmt.Errorf("failed to put chunk '%s': %v", k, err)
+	}
+
+	return k, s.updateStats(tx, 1, int64(len(c)), int64(len(payload)))
+}
+
+//Get returns the content of the chunk stored under 'k'
+func (s *ChunkStore) Get(tx *bolt.Tx, k K) (c Chunk, err error) {
+	v := tx.Bucket(BucketNameChunks).Get(k[:])
+	if v == nil {
+		return nil, ErrChunkNotExist
+	}
+
+	hdr, payload, err := decodeChunkRecord(k, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cipher != nil {
+		payload, err = s.cipher.open(k, payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open chunk '%s': %v", k, err)
+		}
+	}
+
+	data, err := decodePayload(payload, hdr.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode chunk '%s': %v", k, err)
+	}
+
+	return Chunk(data), nil
+}
+
+//Refs returns how often the chunk stored under 'k' is referenced
+func (s *ChunkStore) Refs(tx *bolt.Tx, k K) (n uint64, err error) {
+	v := tx.Bucket(BucketNameChunks).Get(k[:])
+	if v == nil {
+		return 0, ErrChunkNotExist
+	}
+
+	hdr, _, err := decodeChunkRecord(k, v)
+	if err != nil {
+		return 0, err
+	}
+
+	return hdr.Refs, nil
+}
+
+//Ref adds a reference to an already stored chunk
+func (s *ChunkStore) Ref(tx *bolt.Tx, k K) error {
+	b := tx.Bucket(BucketNameChunks)
+	v := b.Get(k[:])
+	if v == nil {
+		return ErrChunkNotExist
+	}
+
+	hdr, payload, err := decodeChunkRecord(k, v)
+	if err != nil {
+		return err
+	}
+
+	hdr.Refs++
+	hdr.Gen = s.generation(tx)
+	if err = b.Put(k[:], encodeChunkRecord(hdr, payload)); err != nil {
+		return fmt.Errorf("failed to reference chunk '%s': %v", k, err)
+	}
+
+	return s.updateStats(tx, 0, int64(hdr.Size), 0)
+}
+
+//Unref removes a reference to a stored chunk, the chunk is deleted when it
+//was the last reference
+func (s *ChunkStore) Unref(tx *bolt.Tx, k K) error {
+	b := tx.Bucket(BucketNameChunks)
+	v := b.Get(k[:])
+	if v == nil {
+		return ErrChunkNotExist
+	}
+
+	hdr, payload, err := decodeChunkRecord(k, v)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Refs > 1 {
+		hdr.Refs--
+		if err = b.Put(k[:], encodeChunkRecord(hdr, payload)); err != nil {
+			return fmt.Errorf("failed to unreference chunk '%s': %v", k, err)
+		}
+
+		return s.updateStats(tx, 0, -int64(hdr.Size), 0)
+	}
+
+	if err = b.Delete(k[:]); err != nil {
+		return fmt.Errorf("failed to delete chunk '%s': %v", k, err)
+	}
+
+	return s.updateStats(tx, -1, -int64(hdr.Size), -int64(len(payload)))
+}
+
+//Release removes a reference for each of the provided keys
+func (s *ChunkStore) Release(tx *bolt.Tx, ks []K) error {
+	for _, k := range ks {
+		if err := s.Unref(tx, k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Key returns the key under which the chunk is stored, for encrypted volumes
+//this is a keyed hash of the content
+func (s *ChunkStore) Key(c Chunk) K {
+	if s.cipher != nil {
+		return s.cipher.key(s.hash, c)
+	}
+
+	return c.Key(s.hash)
+}
+
+//Hash returns the algorithm that keys new chunks
+func (s *ChunkStore) Hash() Hash {
+	return s.hash
+}
+
+//Stats returns statistics about the chunks in the store
+func (s *ChunkStore) Stats(tx *bolt.Tx) (st ChunkStats) {
+	b := tx.Bucket(BucketNameChunkStats)
+	st.Chunks = getCounter(b, keyStatsChunks)
+	st.LogicalBytes = getCounter(b, keyStatsLogical)
+	st.PhysicalBytes = getCounter(b, keyStatsPhysical)
+	return st
+}
+
+//generation returns the current garbage collector generation, chunks that
+//are (re)referenced are marked with it so a concurrent collection that
+//started before won't sweep them
+func (s *ChunkStore) generation(tx *bolt.Tx) uint64 {
+	return getCounter(tx.Bucket(BucketNameChunkStats), keyGeneration)
+}
+
+func (s *ChunkStore) updateStats(tx *bolt.Tx, chunks, logical, physical int64) (err error) {
+	b := tx.Bucket(BucketNameChunkStats)
+	for key, delta := range map[string]int64{
+		string(keyStatsChunks):   chunks,
+		string(keyStatsLogical):  logical,
+		string(keyStatsPhysical): physical,
+	} {
+		if delta == 0 {
+			continue
+		}
+
+		if err = putCounter(b, []byte(key), uint64(int64(getCounter(b, []byte(key)))+delta)); err != nil {
+			return fmt.Errorf("failed to update chunk stats: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func getCounter(b *bolt.Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(v)
+}
+
+func putCounter(b *bolt.Bucket, key []byte, n uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return b.Put(key, v)
+}
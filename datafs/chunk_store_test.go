@@ -0,0 +1,281 @@
+package datafs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/advanderveer/datafs/datafs"
+	"github.com/boltdb/bolt"
+)
+
+func testdb(t tester) *bolt.DB {
+	tmpdir, err := ioutil.TempDir("", "dfs_test_")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	db, err := bolt.Open(filepath.Join(tmpdir, "fs.bolt"), 0666, nil)
+	if err != nil {
+		t.Fatalf("failed to open bolt db: %v", err)
+	}
+
+	return db
+}
+
+func TestChunkStoreRefCounting(t *testing.T) {
+	db := testdb(t)
+	defer db.Close()
+
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	c1 := datafs.Chunk("hello, world")
+	c2 := datafs.Chunk("foo bar")
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, c := range []datafs.Chunk{c1, c1, c2} {
+			if _, err := s.Put(tx, c); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to put chunks: %v", err)
+	}
+
+	if err = db.View(func(tx *bolt.Tx) error {
+		st := s.Stats(tx)
+		if st.Chunks != 2 {
+			t.Errorf("expected 2 unique chunks, got: %d", st.Chunks)
+		}
+
+		if st.LogicalBytes != uint64(2*len(c1)+len(c2)) {
+			t.Errorf("unexpected logical bytes: %d", st.LogicalBytes)
+		}
+
+		//raw payloads carry a single codec byte
+		if st.PhysicalBytes != uint64(len(c1)+len(c2)+2) {
+			t.Errorf("unexpected physical bytes: %d", st.PhysicalBytes)
+		}
+
+		data, err := s.Get(tx, c1.Key(datafs.SHA256))
+		if err != nil || !bytes.Equal(data, c1) {
+			t.Errorf("expected stored chunk to equal input, got: %q (%v)", data, err)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		return s.Release(tx, []datafs.K{c1.Key(datafs.SHA256), c2.Key(datafs.SHA256)})
+	}); err != nil {
+		t.Fatalf("failed to release chunks: %v", err)
+	}
+
+	if err = db.View(func(tx *bolt.Tx) error {
+		if n, err := s.Refs(tx, c1.Key(datafs.SHA256)); err != nil || n != 1 {
+			t.Errorf("expected 1 reference to remain, got: %d (%v)", n, err)
+		}
+
+		if _, err := s.Get(tx, c2.Key(datafs.SHA256)); err != datafs.ErrChunkNotExist {
+			t.Errorf("expected unreferenced chunk to be removed, got: %v", err)
+		}
+
+		st := s.Stats(tx)
+		if st.Chunks != 1 || st.LogicalBytes != uint64(len(c1)) || st.PhysicalBytes != uint64(len(c1)+1) {
+			t.Errorf("unexpected stats after release: %+v", st)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkStoreCollect(t *testing.T) {
+	db := testdb(t)
+	defer db.Close()
+
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	used := datafs.Chunk("still used")
+	leaked := datafs.Chunk("leaked")
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, c := range []datafs.Chunk{used, leaked} {
+			if _, err := s.Put(tx, c); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to put chunks: %v", err)
+	}
+
+	st, err := s.Collect(db, func(tx *bolt.Tx, ref func(datafs.K)) error {
+		ref(used.Key(datafs.SHA256))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to collect: %v", err)
+	}
+
+	if st.Generation != 1 || st.Referenced != 1 || st.Swept != 1 || st.ReclaimedBytes != uint64(len(leaked)+1) {
+		t.Errorf("unexpected gc stats: %+v", st)
+	}
+
+	if err = db.View(func(tx *bolt.Tx) error {
+		if _, err := s.Get(tx, used.Key(datafs.SHA256)); err != nil {
+			t.Errorf("expected referenced chunk to survive, got: %v", err)
+		}
+
+		if _, err := s.Get(tx, leaked.Key(datafs.SHA256)); err != datafs.ErrChunkNotExist {
+			t.Errorf("expected leaked chunk to be swept, got: %v", err)
+		}
+
+		if st := s.Stats(tx); st.Chunks != 1 || st.PhysicalBytes != uint64(len(used)+1) {
+			t.Errorf("unexpected stats after gc: %+v", st)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkStoreCompression(t *testing.T) {
+	text := datafs.Chunk(bytes.Repeat([]byte("id,name,value\n1,foo,3.14\n"), 1000))
+	noise := make(datafs.Chunk, 4096)
+	rand.New(rand.NewSource(4)).Read(noise)
+
+	for _, codec := range []datafs.Codec{datafs.CodecFast, datafs.CodecBest} {
+		db := testdb(t)
+		s, err := datafs.NewChunkStore(db, &datafs.Options{Compression: codec})
+		if err != nil {
+			t.Fatalf("failed to create chunk store: %v", err)
+		}
+
+		if err = db.Update(func(tx *bolt.Tx) error {
+			for _, c := range []datafs.Chunk{text, noise} {
+				if _, err := s.Put(tx, c); err != nil {
+					return err
+				}
+			}
+
+			st := s.Stats(tx)
+			if st.PhysicalBytes >= uint64(len(text))/4+uint64(len(noise))+1 {
+				t.Errorf("expected %s codec to compress text, got stats: %+v", codec, st)
+			}
+
+			for _, c := range []datafs.Chunk{text, noise} {
+				data, err := s.Get(tx, s.Key(c))
+				if err != nil || !bytes.Equal(data, c) {
+					t.Errorf("expected %s chunk to decode to its content (%v)", codec, err)
+				}
+			}
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestChunkStoreEncryption(t *testing.T) {
+	db := testdb(t)
+	defer db.Close()
+
+	secret := []byte("correct horse battery staple")
+	s, err := datafs.NewChunkStore(db, &datafs.Options{Secret: secret, Compression: datafs.CodecFast})
+	if err != nil {
+		t.Fatalf("failed to create encrypted chunk store: %v", err)
+	}
+
+	c := datafs.Chunk(bytes.Repeat([]byte("secret customer data "), 100))
+	var k datafs.K
+	if err = db.Update(func(tx *bolt.Tx) error {
+		k, err = s.Put(tx, c)
+		return err
+	}); err != nil {
+		t.Fatalf("failed to put chunk: %v", err)
+	}
+
+	if k.Equal(c.Key(s.Hash())) {
+		t.Errorf("expected the plain content hash not to be used as key")
+	}
+
+	if err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(datafs.BucketNameChunks).ForEach(func(kb, v []byte) error {
+			if bytes.Contains(v, []byte("secret customer data")) {
+				t.Errorf("expected chunk to be stored encrypted")
+			}
+
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = datafs.NewChunkStore(db, nil); err != datafs.ErrKeyRequired {
+		t.Errorf("expected opening without key to fail with ErrKeyRequired, got: %v", err)
+	}
+
+	if _, err = datafs.NewChunkStore(db, &datafs.Options{Secret: []byte("wrong")}); err != datafs.ErrInvalidKey {
+		t.Errorf("expected opening with the wrong key to fail with ErrInvalidKey, got: %v", err)
+	}
+
+	s, err = datafs.NewChunkStore(db, &datafs.Options{Secret: secret})
+	if err != nil {
+		t.Fatalf("failed to reopen encrypted chunk store: %v", err)
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		data, err := s.Get(tx, k)
+		if err != nil || !bytes.Equal(data, c) {
+			t.Errorf("expected chunk to decrypt to its content (%v)", err)
+		}
+
+		k2, err := s.Put(tx, c)
+		if err != nil || !k2.Equal(k) {
+			t.Errorf("expected equal content to de-duplicate (%v)", err)
+		}
+
+		if st := s.Stats(tx); st.Chunks != 1 {
+			t.Errorf("expected a single stored chunk, got: %+v", st)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := testdb(t)
+	defer plain.Close()
+	ps, err := datafs.NewChunkStore(plain, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	if err = plain.Update(func(tx *bolt.Tx) error {
+		_, err := ps.Put(tx, c)
+		return err
+	}); err != nil {
+		t.Fatalf("failed to put chunk: %v", err)
+	}
+
+	if _, err = datafs.NewChunkStore(plain, &datafs.Options{Secret: secret}); err != datafs.ErrNotEncrypted {
+		t.Errorf("expected encrypting a volume with chunks to fail with ErrNotEncrypted, got: %v", err)
+	}
+}
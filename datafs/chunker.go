@@ -0,0 +1,173 @@
+package datafs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+//chunkerWindow is the number of bytes the rolling hash considers when
+//deciding on a chunk boundary
+const chunkerWindow = 48
+
+var (
+	//ErrInvalidChunkerConfig is returned when chunk sizes are inconsistent
+	ErrInvalidChunkerConfig = errors.New("Invalid chunker configuration")
+)
+
+//DefaultChunkerConfig is used when no chunk sizes are configured explicitly
+var DefaultChunkerConfig = ChunkerConfig{
+	MinSize: 256 * 1024,
+	AvgSize: 1024 * 1024,
+	MaxSize: 4 * 1024 * 1024,
+}
+
+//ChunkerConfig determines the sizes of the content-defined chunks, boundaries
+//are never placed before MinSize or after MaxSize and on average every AvgSize
+//bytes. AvgSize must be a power of two
+type ChunkerConfig struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+//Validate checks if the configured sizes can be used for chunking
+func (conf ChunkerConfig) Validate() error {
+	if conf.MinSize < chunkerWindow {
+		return fmt.Errorf("%v: minimum size must be at least %d bytes", ErrInvalidChunkerConfig, chunkerWindow)
+	}
+
+	if conf.AvgSize&(conf.AvgSize-1) != 0 {
+		return fmt.Errorf("%v: average size must be a power of two", ErrInvalidChunkerConfig)
+	}
+
+	if conf.MinSize > conf.AvgSize || conf.AvgSize > conf.MaxSize {
+		return fmt.Errorf("%v: expected min <= avg <= max", ErrInvalidChunkerConfig)
+	}
+
+	return nil
+}
+
+//buzTable maps each byte to a pseudo random value for the rolling hash, it
+//is generated deterministically since the chunk boundaries (and therefore
+//de-duplication) depend on it staying the same between releases
+var buzTable [256]uint32
+
+func init() {
+	var x uint64 = 0x6461746166730001 //splitmix64 seed
+	for i := range buzTable {
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		buzTable[i] = uint32(z ^ (z >> 31))
+	}
+}
+
+func rotl(x uint32, n uint) uint32 {
+	n = n % 32
+	return x<<n | x>>(32-n)
+}
+
+//Chunker splits a stream of bytes into chunks at positions that are
+//determined by the content (a Buzhash over a sliding window) instead of by
+//a fixed offset. Inserting or removing bytes therefore only changes the
+//chunks around the edit, boundaries further on re-synchronize.
+type Chunker struct {
+	r    io.Reader
+	conf ChunkerConfig
+	mask uint32
+	buf  []byte
+	pos  int
+	eof  bool
+}
+
+//NewChunker sets up a chunker that reads from 'r'
+func NewChunker(r io.Reader, conf ChunkerConfig) (c *Chunker, err error) {
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Chunker{
+		r:    r,
+		conf: conf,
+		mask: uint32(conf.AvgSize - 1),
+		buf:  make([]byte, 0, 2*conf.MaxSize),
+	}, nil
+}
+
+//Next returns the next chunk from the stream, io.EOF is returned when
+//the underlying reader has no more data
+func (c *Chunker) Next() (Chunk, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+
+	data := c.buf[c.pos:]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(data)
+	chunk := make(Chunk, n)
+	copy(chunk, data[:n])
+	c.pos += n
+	return chunk, nil
+}
+
+//fill reads from the underlying reader until at least MaxSize bytes are
+//buffered or the reader is exhausted
+func (c *Chunker) fill() error {
+	if c.eof || len(c.buf)-c.pos >= c.conf.MaxSize {
+		return nil
+	}
+
+	n := copy(c.buf[:cap(c.buf)], c.buf[c.pos:])
+	c.buf = c.buf[:n]
+	c.pos = 0
+	for len(c.buf) < c.conf.MaxSize {
+		m, err := c.r.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+m]
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read chunker input: %v", err)
+		}
+	}
+
+	return nil
+}
+
+//cut returns the length of the next chunk at the start of 'data'
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.conf.MinSize {
+		return len(data)
+	}
+
+	max := len(data)
+	if max > c.conf.MaxSize {
+		max = c.conf.MaxSize
+	}
+
+	var h uint32
+	i := c.conf.MinSize - chunkerWindow
+	for ; i < c.conf.MinSize; i++ {
+		h = rotl(h, 1) ^ buzTable[data[i]]
+	}
+
+	for ; i < max; i++ {
+		if h&c.mask == 0 {
+			return i
+		}
+
+		h = rotl(h, 1) ^ rotl(buzTable[data[i-chunkerWindow]], chunkerWindow) ^ buzTable[data[i]]
+	}
+
+	return max
+}
+
+//Key returns the content hash under which the chunk is stored
+func (c Chunk) Key(h Hash) K {
+	return h.Sum(c)
+}
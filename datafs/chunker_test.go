@@ -0,0 +1,99 @@
+package datafs_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/advanderveer/datafs/datafs"
+)
+
+var testChunkerConfig = datafs.ChunkerConfig{
+	MinSize: 2 * 1024,
+	AvgSize: 8 * 1024,
+	MaxSize: 32 * 1024,
+}
+
+func chunkAll(t *testing.T, data []byte) (chunks []datafs.Chunk) {
+	c, err := datafs.NewChunker(bytes.NewReader(data), testChunkerConfig)
+	if err != nil {
+		t.Fatalf("failed to create chunker: %v", err)
+	}
+
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to chunk: %v", err)
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data)
+	if len(chunks) < 2 {
+		t.Fatalf("expected data to be split into multiple chunks, got: %d", len(chunks))
+	}
+
+	joined := []byte{}
+	for i, chunk := range chunks {
+		if len(chunk) > testChunkerConfig.MaxSize {
+			t.Errorf("chunk %d is larger then max size: %d", i, len(chunk))
+		}
+
+		if i < len(chunks)-1 && len(chunk) < testChunkerConfig.MinSize {
+			t.Errorf("chunk %d is smaller then min size: %d", i, len(chunk))
+		}
+
+		joined = append(joined, chunk...)
+	}
+
+	if !bytes.Equal(joined, data) {
+		t.Errorf("joined chunks should equal the input")
+	}
+}
+
+func TestChunkerResyncsAfterInsert(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	before := map[string]bool{}
+	for _, chunk := range chunkAll(t, data) {
+		before[chunk.Key(datafs.SHA256).String()] = true
+	}
+
+	edited := append([]byte("inserted at the start"), data...)
+	after := chunkAll(t, edited)
+
+	changed := 0
+	for _, chunk := range after {
+		if !before[chunk.Key(datafs.SHA256).String()] {
+			changed++
+		}
+	}
+
+	if changed > 2 {
+		t.Errorf("expected an insert to only change the first chunks, got %d of %d changed", changed, len(after))
+	}
+}
+
+func TestInvalidChunkerConfig(t *testing.T) {
+	for _, conf := range []datafs.ChunkerConfig{
+		{MinSize: 1, AvgSize: 8, MaxSize: 16},
+		{MinSize: 1024, AvgSize: 3000, MaxSize: 8192},
+		{MinSize: 8192, AvgSize: 4096, MaxSize: 16384},
+	} {
+		if _, err := datafs.NewChunker(bytes.NewReader(nil), conf); err == nil {
+			t.Errorf("expected config %+v to be invalid", conf)
+		}
+	}
+}
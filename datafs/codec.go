@@ -0,0 +1,143 @@
+package datafs
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	//ErrUnknownCodec is returned when a chunk is stored with an unsupported codec
+	ErrUnknownCodec = errors.New("Unknown chunk codec")
+)
+
+//Codec identifies how a chunk's payload is encoded in the chunks bucket, it
+//is stored as the first byte of every payload
+type Codec byte
+
+const (
+	//CodecRaw stores the chunk content as-is
+	CodecRaw Codec = 0
+
+	//CodecFast compresses with DEFLATE at its fastest level
+	CodecFast Codec = 1
+
+	//CodecBest compresses with DEFLATE at its highest compression level
+	CodecBest Codec = 2
+)
+
+var codecNames = map[Codec]string{
+	CodecRaw:  "raw",
+	CodecFast: "fast",
+	CodecBest: "best",
+}
+
+var codecLevels = map[Codec]int{
+	CodecFast: flate.BestSpeed,
+	CodecBest: flate.BestCompression,
+}
+
+//flate writers are expensive to allocate so they are reused per codec
+var codecWriters = map[Codec]*sync.Pool{}
+
+func init() {
+	for c, level := range codecLevels {
+		level := level
+		codecWriters[c] = &sync.Pool{New: func() interface{} {
+			w, _ := flate.NewWriter(nil, level)
+			return w
+		}}
+	}
+}
+
+//ParseCodec returns the codec with the given name
+func ParseCodec(name string) (Codec, error) {
+	for c, n := range codecNames {
+		if n == name {
+			return c, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%v: '%s'", ErrUnknownCodec, name)
+}
+
+//String returns the name of the codec
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+//Available reports whether the codec is supported
+func (c Codec) Available() bool {
+	_, ok := codecNames[c]
+	return ok
+}
+
+//Encode returns the tagged payload for 'data'. If compressing doesn't make
+//the chunk smaller it is stored raw instead.
+func (c Codec) Encode(data []byte) (payload []byte, err error) {
+	if c != CodecRaw {
+		pool, ok := codecWriters[c]
+		if !ok {
+			return nil, ErrUnknownCodec
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, len(data)+1))
+		buf.WriteByte(byte(c))
+
+		w := pool.Get().(*flate.Writer)
+		defer pool.Put(w)
+		w.Reset(buf)
+		if _, err = w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to compress chunk: %v", err)
+		}
+
+		if err = w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress chunk: %v", err)
+		}
+
+		if buf.Len() < len(data)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+
+	payload = make([]byte, len(data)+1)
+	payload[0] = byte(CodecRaw)
+	copy(payload[1:], data)
+	return payload, nil
+}
+
+//decodePayload returns the content of a tagged payload, 'size' is the
+//expected length of the content
+func decodePayload(payload []byte, size uint64) (data []byte, err error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("chunk payload is missing its codec")
+	}
+
+	switch c := Codec(payload[0]); c {
+	case CodecRaw:
+		data = make([]byte, len(payload)-1)
+		copy(data, payload[1:])
+	case CodecFast, CodecBest:
+		r := flate.NewReader(bytes.NewReader(payload[1:]))
+		defer r.Close()
+		data = make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to decompress %s chunk: %v", c, err)
+		}
+	default:
+		return nil, fmt.Errorf("%v: %s", ErrUnknownCodec, c)
+	}
+
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("chunk has %d bytes of content, expected %d", len(data), size)
+	}
+
+	return data, nil
+}
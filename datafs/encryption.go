@@ -0,0 +1,180 @@
+package datafs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	//ErrKeyRequired is returned when opening an encrypted volume without a secret
+	ErrKeyRequired = errors.New("Volume is encrypted, a key is required")
+
+	//ErrInvalidKey is returned when the secret doesn't match the one the volume was encrypted with
+	ErrInvalidKey = errors.New("Invalid volume key")
+
+	//ErrNotEncrypted is returned when a secret is provided for a volume that already holds unencrypted chunks
+	ErrNotEncrypted = errors.New("Volume is not encrypted")
+)
+
+var keyVolumeEncryption = []byte("encryption")
+
+//kdfIterations is the number of PBKDF2 rounds that turn the volume secret
+//into the volume key for new volumes
+const kdfIterations = 600000
+
+//volumeEncryption is stored in the volume bucket of encrypted volumes, it
+//holds what is needed to derive and verify the volume key from a secret
+type volumeEncryption struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iter"`
+	Check      []byte `json:"check"`
+}
+
+//ReadKeyFile reads a volume secret from a file
+func ReadKeyFile(path string) (secret []byte, err error) {
+	secret, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("key file '%s' is empty", path)
+	}
+
+	return secret, nil
+}
+
+//chunkCipher encrypts chunks convergently: a chunk's key is derived from its
+//content and the volume key, such that equal content still de-duplicates
+//but nothing about the content can be learned without the volume key
+type chunkCipher struct {
+	idKey  []byte //keys the content hash that identifies a chunk
+	encKey []byte //derives the encryption key of a chunk from its identity
+}
+
+//newChunkCipher derives the chunk keys from the volume key
+func newChunkCipher(volumeKey []byte) (cc *chunkCipher, err error) {
+	cc = &chunkCipher{idKey: make([]byte, 32), encKey: make([]byte, 32)}
+	if _, err = io.ReadFull(hkdf.New(sha256.New, volumeKey, nil, []byte("datafs chunk id")), cc.idKey); err != nil {
+		return nil, fmt.Errorf("failed to derive chunk id key: %v", err)
+	}
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, volumeKey, nil, []byte("datafs chunk encryption")), cc.encKey); err != nil {
+		return nil, fmt.Errorf("failed to derive chunk encryption key: %v", err)
+	}
+
+	return cc, nil
+}
+
+//key returns the identity of a chunk: a keyed hash of its content, this
+//way the plain content hash is never stored
+func (cc *chunkCipher) key(h Hash, c Chunk) K {
+	mac := hmac.New(h.New, cc.idKey)
+	mac.Write(c)
+	return h.key(mac.Sum(nil))
+}
+
+//aead returns the cipher for the chunk with identity 'k'. Since the key is
+//unique for every content a fixed nonce is safe: it is only ever reused to
+//encrypt the exact same plaintext.
+func (cc *chunkCipher) aead(k K) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, cc.encKey)
+	mac.Write(k)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (cc *chunkCipher) seal(k K, payload []byte) ([]byte, error) {
+	aead, err := cc.aead(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup cipher: %v", err)
+	}
+
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), payload, k), nil
+}
+
+func (cc *chunkCipher) open(k K, sealed []byte) ([]byte, error) {
+	aead, err := cc.aead(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup cipher: %v", err)
+	}
+
+	payload, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk: %v", err)
+	}
+
+	return payload, nil
+}
+
+//keyCheck returns a value that verifies a volume key without revealing it
+func keyCheck(volumeKey []byte) []byte {
+	mac := hmac.New(sha256.New, volumeKey)
+	mac.Write([]byte("datafs key check"))
+	return mac.Sum(nil)
+}
+
+//setupEncryption returns the chunk cipher of the volume, or nil if the
+//volume isn't encrypted. A new volume is encrypted when a secret is
+//provided, volumes that already hold chunks can't become encrypted.
+func setupEncryption(tx *bolt.Tx, secret []byte) (cc *chunkCipher, err error) {
+	vb := tx.Bucket(BucketNameVolume)
+	ve := &volumeEncryption{}
+	if data := vb.Get(keyVolumeEncryption); data != nil {
+		if err = json.Unmarshal(data, ve); err != nil {
+			return nil, fmt.Errorf("failed to deserialize volume encryption: %v", err)
+		}
+
+		if len(secret) == 0 {
+			return nil, ErrKeyRequired
+		}
+	} else {
+		if len(secret) == 0 {
+			return nil, nil
+		}
+
+		if k, _ := tx.Bucket(BucketNameChunks).Cursor().First(); k != nil {
+			return nil, ErrNotEncrypted
+		}
+
+		ve.Salt = make([]byte, 16)
+		if _, err = rand.Read(ve.Salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %v", err)
+		}
+
+		ve.Iterations = kdfIterations
+	}
+
+	volumeKey := pbkdf2.Key(secret, ve.Salt, ve.Iterations, 32, sha256.New)
+	if ve.Check == nil {
+		ve.Check = keyCheck(volumeKey)
+		data, err := json.Marshal(ve)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize volume encryption: %v", err)
+		}
+
+		if err = vb.Put(keyVolumeEncryption, data); err != nil {
+			return nil, err
+		}
+	} else if !hmac.Equal(ve.Check, keyCheck(volumeKey)) {
+		return nil, ErrInvalidKey
+	}
+
+	return newChunkCipher(volumeKey)
+}
@@ -0,0 +1,1988 @@
+package datafs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/advanderveer/datafs/datafs"
+	"github.com/boltdb/bolt"
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/dokan/winacl"
+	"golang.org/x/net/context"
+)
+
+func testFileSystem(t tester) *datafs.FileSystem {
+	fs, err := datafs.NewFileSystem(testdb(t), nil)
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	return fs
+}
+
+//testBufferedFileSystem keeps writes buffered until the test flushes or
+//closes the file, or the buffer exceeds a megabyte
+func testBufferedFileSystem(t tester, db *bolt.DB) *datafs.FileSystem {
+	fs, err := datafs.NewFileSystem(db, &datafs.Options{
+		Chunking:        testChunkerConfig,
+		WriteBufferSize: 1024 * 1024,
+		WriteBufferAge:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	return fs
+}
+
+func TestOpenFlags(t *testing.T) {
+	fs := testFileSystem(t)
+
+	if _, err := fs.Open(os.O_RDONLY, []byte("a.txt")); err != datafs.ErrNotExist {
+		t.Errorf("expected opening a non existing file to fail with ErrNotExist, got: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE|os.O_EXCL, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("expected exclusive create to succeed, got: %v", err)
+	}
+
+	if f.IsDir() {
+		t.Errorf("expected created file not to be a directory")
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE|os.O_EXCL, []byte("a.txt")); err != datafs.ErrExists {
+		t.Errorf("expected second exclusive create to fail with ErrExists, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt")); err != nil {
+		t.Errorf("expected non-exclusive create of existing file to succeed, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_TRUNC, []byte("a.txt")); err != datafs.ErrReadOnly {
+		t.Errorf("expected truncating a read-only open to fail with ErrReadOnly, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"), []byte("b.txt")); err != datafs.ErrNotDirectory {
+		t.Errorf("expected creating under a file to fail with ErrNotDirectory, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE, []byte("dir"), []byte("b.txt")); err != datafs.ErrPathNotFound {
+		t.Errorf("expected creating under a missing directory to fail with ErrPathNotFound, got: %v", err)
+	}
+
+	if _, err = fs.FollowSymlinks([]byte("dir"), []byte("b.txt")); err != datafs.ErrPathNotFound {
+		t.Errorf("expected following links under a missing directory to fail with ErrPathNotFound, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR | os.O_TRUNC); err != datafs.ErrIsDirectory {
+		t.Errorf("expected truncating the root to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	wroot, err := fs.Open(os.O_RDWR)
+	if err != nil || !wroot.IsDir() {
+		t.Errorf("expected opening the root for writing to fall back to a directory handle, got: %v", err)
+	} else if _, err = wroot.Write(0, []byte("x")); err != datafs.ErrReadOnly {
+		t.Errorf("expected the directory handle to be read-only, got: %v", err)
+	}
+
+	root, err := fs.Open(os.O_RDONLY)
+	if err != nil || !root.IsDir() {
+		t.Errorf("expected root to open as a directory, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY, []byte("..")); err != datafs.ErrInvalidName {
+		t.Errorf("expected '..' to be an invalid name, got: %v", err)
+	}
+}
+
+func TestRandomAccessRead(t *testing.T) {
+	fs := testBufferedFileSystem(t, testdb(t))
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	content := make([]byte, 128*1024)
+	rand.New(rand.NewSource(4)).Read(content)
+	if _, err = f.Write(0, content); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	f, err = fs.Open(os.O_RDONLY, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	//reads of various sizes that start and end inside of and across chunks
+	for offset := 0; offset < len(content); offset += 997 {
+		for _, size := range []int{1, 100, 5000, 40000} {
+			if offset+size > len(content) {
+				continue
+			}
+
+			buf := make([]byte, size)
+			n, err := f.Read(int64(offset), buf)
+			if err != nil || !bytes.Equal(buf[:n], content[offset:offset+size]) {
+				t.Fatalf("read at %d of %d bytes returned %d bytes (%v)", offset, size, n, err)
+			}
+		}
+	}
+
+	buf := make([]byte, 10)
+	n, err := f.Read(int64(len(content)-5), buf)
+	if err != io.EOF || !bytes.Equal(buf[:n], content[len(content)-5:]) {
+		t.Errorf("expected short read at the end of the file to return EOF, got: %q (%v)", buf[:n], err)
+	}
+}
+
+func TestInodes(t *testing.T) {
+	fs := testFileSystem(t)
+
+	root, err := fs.Open(os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open root: %v", err)
+	}
+
+	a, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	b, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("b.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if root.Ino() == 0 || a.Ino() == root.Ino() || a.Ino() == b.Ino() {
+		t.Errorf("expected distinct inode numbers, got: %d, %d and %d", root.Ino(), a.Ino(), b.Ino())
+	}
+
+	again, err := fs.Open(os.O_RDONLY, []byte("a.txt"))
+	if err != nil || again.Ino() != a.Ino() {
+		t.Errorf("expected reopening to return the same inode, got: %d (%v)", again.Ino(), err)
+	}
+}
+
+func TestFileIndexStability(t *testing.T) {
+	db := testdb(t)
+	fs, err := datafs.NewFileSystem(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	ino := f.Ino()
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("a.txt")}, [][]byte{[]byte("b.txt")}, false); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+
+	//a remount sets up a new file system on the same database
+	if fs, err = datafs.NewFileSystem(db, nil); err != nil {
+		t.Fatalf("failed to remount: %v", err)
+	}
+
+	if f, err = fs.Open(os.O_RDONLY, []byte("b.txt")); err != nil {
+		t.Fatalf("failed to open renamed file: %v", err)
+	}
+
+	if f.Ino() != ino {
+		t.Errorf("expected index %d to survive rename and remount, got: %d", ino, f.Ino())
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Remove([]byte("b.txt")); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+
+	//removing the newest inode must not make its number available again
+	if f, err = fs.Open(os.O_RDWR|os.O_CREATE, []byte("c.txt")); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if f.Ino() <= ino {
+		t.Errorf("expected a new file to get a higher index than %d, got: %d", ino, f.Ino())
+	}
+}
+
+func TestMigratePathMetadata(t *testing.T) {
+	db := testdb(t)
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		k, err := s.Put(tx, datafs.Chunk("hello, world"))
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucket(datafs.BucketNameMetadata)
+		if err != nil {
+			return err
+		}
+
+		for path, f := range map[string]*datafs.BoltFile{
+			"/":          {IsDirectory: true},
+			"/dir":       {IsDirectory: true},
+			"/dir/a.txt": {Size: 12, Chunks: []datafs.ChunkRef{{K: k, Size: 12}}},
+		} {
+			data, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+
+			if err = b.Put([]byte(path), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to write path metadata: %v", err)
+	}
+
+	fs, err := datafs.NewFileSystem(db, nil)
+	if err != nil {
+		t.Fatalf("failed to migrate file system: %v", err)
+	}
+
+	dir, err := fs.Open(os.O_RDONLY, []byte("dir"))
+	if err != nil || !dir.IsDir() {
+		t.Fatalf("expected migrated directory to open as a directory, got: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDONLY, []byte("dir"), []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open migrated file: %v", err)
+	}
+
+	buf := make([]byte, 12)
+	if n, err := f.Read(0, buf); err != nil || string(buf[:n]) != "hello, world" {
+		t.Errorf("expected migrated content to be readable, got: %q (%v)", buf[:n], err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(datafs.BucketNameMetadata) != nil {
+			t.Errorf("expected path metadata bucket to be removed")
+		}
+		return nil
+	})
+}
+
+func TestBufferedWrites(t *testing.T) {
+	db := testdb(t)
+	fs := testBufferedFileSystem(t, db)
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	stats := func() (st datafs.ChunkStats) {
+		db.View(func(tx *bolt.Tx) error {
+			st = s.Stats(tx)
+			return nil
+		})
+		return st
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_CREATE, []byte("a.bin")); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	ro, err := fs.Open(os.O_RDONLY, []byte("a.bin"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if _, err = ro.Write(0, []byte("x")); err != datafs.ErrReadOnly {
+		t.Errorf("expected write to read-only file to fail with ErrReadOnly, got: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR, []byte("a.bin"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	//write out of order in small pieces
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(3)).Read(content)
+	for off := len(content) - 1000; off >= 0; off -= 1000 {
+		if _, err = f.Write(int64(off), content[off:off+1000]); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	if _, err = f.Write(0, content[:len(content)%1000]); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if st := stats(); st.Chunks != 0 {
+		t.Errorf("expected writes to be buffered, got %d chunks", st.Chunks)
+	}
+
+	buf := make([]byte, len(content))
+	if n, err := f.Read(0, buf); err != nil || !bytes.Equal(buf[:n], content) {
+		t.Errorf("expected buffered writes to be readable, got %d bytes (%v)", n, err)
+	}
+
+	if err = f.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	before := stats()
+	if before.Chunks < 4 || before.LogicalBytes != uint64(len(content)) {
+		t.Errorf("unexpected stats after flush: %+v", before)
+	}
+
+	if st, err := fs.ChunkStats(); err != nil || st != before {
+		t.Errorf("expected the file system to report the stats of its chunk store, got: %+v (%v)", st, err)
+	}
+
+	//overwriting a few bytes should only re-chunk the region around them
+	copy(content[100000:], "some edit")
+	if _, err = f.Write(100000, []byte("some edit")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if after := stats(); after.Chunks > before.Chunks+2 || after.LogicalBytes != uint64(len(content)) {
+		t.Errorf("expected an edit to only change chunks around it, before: %+v after: %+v", before, after)
+	}
+
+	a, err := fs.Open(os.O_WRONLY|os.O_APPEND, []byte("a.bin"))
+	if err != nil {
+		t.Fatalf("failed to open file for appending: %v", err)
+	}
+
+	if _, err = a.Write(0, []byte("appended")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	content = append(content, "appended"...)
+	r, err := fs.Open(os.O_RDONLY, []byte("a.bin"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	buf = make([]byte, len(content)+10)
+	if n, err := r.Read(0, buf); err != io.EOF || !bytes.Equal(buf[:n], content) {
+		t.Errorf("expected committed content to be read back, got %d bytes (%v)", n, err)
+	}
+}
+
+func TestBufferedWritesAcrossHandles(t *testing.T) {
+	fs := testBufferedFileSystem(t, testdb(t))
+	a, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	b, err := fs.Open(os.O_RDWR, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if _, err = a.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	buf := make([]byte, 10)
+	if n, err := b.Read(0, buf); err != io.EOF || string(buf[:n]) != "hello" || b.Size() != 5 {
+		t.Errorf("expected other handle to read the buffered writes, got: %q of %d bytes (%v)", buf[:n], b.Size(), err)
+	}
+
+	if _, err = a.Write(5, []byte(", world")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = b.Truncate(2); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if n, err := b.Read(0, buf); err != io.EOF || string(buf[:n]) != "he" || b.Size() != 2 {
+		t.Errorf("expected closing the writer not to undo the truncate of the other handle, got: %q of %d bytes (%v)", buf[:n], b.Size(), err)
+	}
+}
+
+func TestWriteBufferAge(t *testing.T) {
+	db := testdb(t)
+	fs, err := datafs.NewFileSystem(db, &datafs.Options{
+		Chunking:        testChunkerConfig,
+		WriteBufferSize: 1024 * 1024,
+		WriteBufferAge:  50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	committed := func() (size int64) {
+		db.View(func(tx *bolt.Tx) error {
+			meta, err := datafs.LoadBoltFile(tx.Bucket(datafs.BucketNameFiles), f.Ino())
+			if err != nil {
+				t.Fatalf("failed to load file: %v", err)
+			}
+
+			size = meta.Size
+			return nil
+		})
+		return size
+	}
+
+	if _, err = f.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if n := committed(); n != 0 {
+		t.Errorf("expected the write to be buffered, got %d committed bytes", n)
+	}
+
+	//the file is left open without writing to it again
+	deadline := time.Now().Add(5 * time.Second)
+	for committed() != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the buffered write to be committed once it is older than the buffer age")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestTruncateOnOpenAcrossHandles(t *testing.T) {
+	fs := testBufferedFileSystem(t, testdb(t))
+	a, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = a.Write(0, []byte("hello world")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = a.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	if _, err = a.Write(20, []byte("buffered")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	b, err := fs.Open(os.O_RDWR|os.O_TRUNC, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file with O_TRUNC: %v", err)
+	}
+
+	buf := make([]byte, 10)
+	if n, err := a.Read(0, buf); err != io.EOF || n != 0 || a.Size() != 0 {
+		t.Errorf("expected other handle to see the truncated file, got: %q of %d bytes (%v)", buf[:n], a.Size(), err)
+	}
+
+	if _, err = b.Write(0, []byte("hi")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	for _, f := range []*datafs.File{a, b} {
+		if err = f.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+	}
+
+	f, err := fs.Open(os.O_RDONLY, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if n, err := f.Read(0, buf); err != io.EOF || string(buf[:n]) != "hi" {
+		t.Errorf("expected only the writes after the truncate, got: %q (%v)", buf[:n], err)
+	}
+}
+
+func TestConcurrentHandles(t *testing.T) {
+	fs, err := datafs.NewFileSystem(testdb(t), &datafs.Options{
+		Chunking:        testChunkerConfig,
+		WriteBufferSize: 4 * 1024,
+		WriteBufferAge:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	a, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	b, err := fs.Open(os.O_RDWR, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	//dokan calls back from several threads, the race detector checks these
+	var wg sync.WaitGroup
+	for i, f := range []*datafs.File{a, b} {
+		wg.Add(1)
+		go func(i int, f *datafs.File) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, 1024)
+			for off := int64(0); off < 64*1024; off += 1024 {
+				if _, err := f.Write(off, data); err != nil {
+					t.Errorf("failed to write: %v", err)
+				}
+
+				if _, err := f.Read(off/2, make([]byte, 1024)); err != nil && err != io.EOF {
+					t.Errorf("failed to read: %v", err)
+				}
+
+				f.Metadata().GetFileInformation(context.Background(), nil)
+			}
+
+			if err := f.Flush(); err != nil {
+				t.Errorf("failed to flush: %v", err)
+			}
+		}(i, f)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			name := []byte("link" + string(rune('0'+i)))
+			if err := fs.Link([][]byte{[]byte("a.txt")}, [][]byte{name}); err != nil {
+				t.Errorf("failed to link: %v", err)
+			}
+
+			if err := fs.Remove(name); err != nil {
+				t.Errorf("failed to remove link: %v", err)
+			}
+		}
+	}()
+
+	wg.Wait()
+	if a.Size() != 64*1024 || b.Size() != a.Size() {
+		t.Errorf("expected both handles to see all writes, got: %d and %d bytes", a.Size(), b.Size())
+	}
+}
+
+func TestFileInformation(t *testing.T) {
+	fs := testFileSystem(t)
+	start := time.Now()
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = f.Write(0, []byte("hello, world")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	f, err = fs.Open(os.O_RDONLY, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	st, err := f.Metadata().GetFileInformation(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("failed to get file information: %v", err)
+	}
+
+	if st.FileSize != 12 || st.FileIndex != f.Ino() || st.NumberOfLinks != 1 {
+		t.Errorf("unexpected file information: %+v", st)
+	}
+
+	if st.Creation.Before(start) || st.LastWrite.Before(st.Creation) || st.LastAccess.Before(st.Creation) {
+		t.Errorf("unexpected timestamps: %+v", st)
+	}
+
+	if st.FileAttributes != dokan.FileAttributeArchive {
+		t.Errorf("expected written file to have the archive attribute, got: %x", st.FileAttributes)
+	}
+
+	root, err := fs.Open(os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open root: %v", err)
+	}
+
+	if st, _ = root.Metadata().GetFileInformation(context.Background(), nil); st.FileAttributes != dokan.FileAttributeDirectory {
+		t.Errorf("expected root to have the directory attribute, got: %x", st.FileAttributes)
+	}
+}
+
+func TestSetFileTimeAndAttributes(t *testing.T) {
+	fs := testFileSystem(t)
+	ctx := context.Background()
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = f.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	created := f.Metadata().Created
+	if err = f.Metadata().SetFileTime(ctx, nil, time.Time{}, time.Time{}, mtime); err != nil {
+		t.Fatalf("failed to set file time: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = f.Metadata().SetFileAttributes(ctx, nil, dokan.FileAttributeReadonly|dokan.FileAttributeHidden|dokan.FileAttributeDirectory); err != nil {
+		t.Fatalf("failed to set file attributes: %v", err)
+	}
+
+	r, err := fs.Open(os.O_RDONLY, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	st, err := r.Metadata().GetFileInformation(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to get file information: %v", err)
+	}
+
+	if !st.LastWrite.Equal(mtime) || !st.Creation.Equal(created) {
+		t.Errorf("expected explicit modification time to survive close, got: %+v", st)
+	}
+
+	if st.FileAttributes != dokan.FileAttributeReadonly|dokan.FileAttributeHidden {
+		t.Errorf("unexpected attributes: %x", st.FileAttributes)
+	}
+
+	if _, err = f.Write(0, []byte("x")); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected write to read-only file to fail, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR, []byte("a.txt")); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected opening a read-only file for writing to fail, got: %v", err)
+	}
+
+	if err = r.Metadata().SetFileAttributes(ctx, nil, dokan.FileAttributeNormal); err != nil {
+		t.Fatalf("failed to clear file attributes: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR, []byte("a.txt")); err != nil {
+		t.Errorf("expected clearing the read-only attribute to allow writing, got: %v", err)
+	}
+}
+
+func TestOpenDirectories(t *testing.T) {
+	fs := testFileSystem(t)
+
+	dir, err := fs.Open(os.O_RDONLY|os.O_CREATE|os.O_EXCL|datafs.O_DIRECTORY, []byte("dir"))
+	if err != nil || !dir.IsDir() {
+		t.Fatalf("expected directory to be created, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_CREATE|os.O_EXCL|datafs.O_DIRECTORY, []byte("dir")); err != datafs.ErrExists {
+		t.Errorf("expected creating an existing directory to fail with ErrExists, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE|datafs.O_DIRECTORY, []byte("other")); err != datafs.ErrIsDirectory {
+		t.Errorf("expected creating a directory for writing to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|datafs.O_NOTDIRECTORY, []byte("dir")); err != datafs.ErrIsDirectory {
+		t.Errorf("expected O_NOTDIRECTORY on a directory to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE|datafs.O_NOTDIRECTORY, []byte("dir"), []byte("a.txt"))
+	if err != nil || f.IsDir() {
+		t.Fatalf("expected file to be created in directory, got: %v", err)
+	}
+
+	if _, err = f.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|datafs.O_DIRECTORY, []byte("dir"), []byte("a.txt")); err != datafs.ErrNotDirectory {
+		t.Errorf("expected O_DIRECTORY on a file to fail with ErrNotDirectory, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_TRUNC, []byte("dir"), []byte("b.txt")); err != datafs.ErrNotExist {
+		t.Errorf("expected overwriting a missing file to fail with ErrNotExist, got: %v", err)
+	}
+
+	f, err = fs.Open(os.O_RDWR|os.O_CREATE|os.O_TRUNC, []byte("dir"), []byte("a.txt"))
+	if err != nil || f.Size() != 0 {
+		t.Errorf("expected overwriting to truncate the file, got: %v", err)
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	fs := testFileSystem(t)
+	for _, p := range [][][]byte{
+		{[]byte("b.txt")},
+		{[]byte("a.txt")},
+		{[]byte("ab.txt")},
+		{[]byte("readme")},
+		{[]byte("foo.tar.gz")},
+	} {
+		if _, err := fs.Open(os.O_RDWR|os.O_CREATE, p...); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+	}
+
+	if _, err := fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir")); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	c, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("dir"), []byte("c.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = c.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	names := func(ls []*datafs.File) (s []string) {
+		for _, f := range ls {
+			s = append(s, string(f.Name()))
+		}
+		return s
+	}
+
+	ls, err := fs.List()
+	if err != nil {
+		t.Fatalf("failed to list root: %v", err)
+	}
+
+	if got := strings.Join(names(ls), ","); got != "a.txt,ab.txt,b.txt,dir,foo.tar.gz,readme" {
+		t.Errorf("unexpected listing of root: %s", got)
+	}
+
+	if _, err = fs.List([]byte("a.txt")); err != datafs.ErrNotDirectory {
+		t.Errorf("expected listing a file to fail with ErrNotDirectory, got: %v", err)
+	}
+
+	root, err := fs.Open(os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open root: %v", err)
+	}
+
+	for pattern, expected := range map[string]string{
+		"*":         "a.txt,ab.txt,b.txt,dir,foo.tar.gz,readme",
+		"*.txt":     "a.txt,ab.txt,b.txt",
+		"?.txt":     "a.txt,b.txt",
+		"a*":        "a.txt,ab.txt",
+		"b.txt":     "b.txt",
+		"c.txt":     "",
+		"<.gz":      "foo.tar.gz",
+		"<.tar":     "",
+		">>.txt":    "a.txt,ab.txt,b.txt",
+		"readme\"*": "readme",
+		"dir\"":     "dir",
+	} {
+		ls, err := root.Readdir([]byte(pattern))
+		if err != nil {
+			t.Fatalf("failed to list with pattern '%s': %v", pattern, err)
+		}
+
+		if got := strings.Join(names(ls), ","); got != expected {
+			t.Errorf("expected pattern '%s' to match '%s', got: '%s'", pattern, expected, got)
+		}
+	}
+
+	ls, err = fs.List([]byte("dir"))
+	if err != nil || strings.Join(names(ls), ",") != "c.txt" {
+		t.Fatalf("unexpected listing of directory: %v (%v)", names(ls), err)
+	}
+
+	//listed files include the buffered writes of their open handles
+	st, _ := ls[0].Metadata().GetFileInformation(context.Background(), nil)
+	if ls[0].Size() != 5 || st.FileSize != 5 || !st.LastWrite.Equal(c.ModTime()) {
+		t.Errorf("expected listing to include the buffered writes, got: %d bytes, %+v", ls[0].Size(), st)
+	}
+}
+
+func TestRename(t *testing.T) {
+	db := testdb(t)
+	fs, err := datafs.NewFileSystem(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	write := func(content string, p ...[]byte) *datafs.File {
+		f, err := fs.Open(os.O_RDWR|os.O_CREATE|os.O_TRUNC, p...)
+		if err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+
+		if _, err = f.Write(0, []byte(content)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+
+		return f
+	}
+
+	read := func(p ...[]byte) string {
+		f, err := fs.Open(os.O_RDONLY, p...)
+		if err != nil {
+			return err.Error()
+		}
+
+		buf := make([]byte, f.Size())
+		f.Read(0, buf)
+		return string(buf)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir")); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir"), []byte("sub")); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	a := write("in a subdirectory", []byte("dir"), []byte("sub"), []byte("a.txt"))
+	write("old content", []byte("b.txt"))
+	tmp := write("new content", []byte("b.txt.tmp"))
+
+	if err = fs.Rename([][]byte{[]byte("dir")}, [][]byte{[]byte("moved")}, false); err != nil {
+		t.Fatalf("failed to move directory: %v", err)
+	}
+
+	if got := read([]byte("moved"), []byte("sub"), []byte("a.txt")); got != "in a subdirectory" {
+		t.Errorf("expected descendants to move with their directory, got: %s", got)
+	}
+
+	if f, err := fs.Open(os.O_RDONLY, []byte("moved"), []byte("sub"), []byte("a.txt")); err != nil || f.Ino() != a.Ino() {
+		t.Errorf("expected moved file to keep its inode, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY, []byte("dir")); err != datafs.ErrNotExist {
+		t.Errorf("expected source to be gone after move, got: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("moved")}, [][]byte{[]byte("moved"), []byte("sub"), []byte("moved")}, false); err != datafs.ErrInvalidMove {
+		t.Errorf("expected moving a directory into its descendant to fail with ErrInvalidMove, got: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("b.txt.tmp")}, [][]byte{[]byte("b.txt")}, false); err != datafs.ErrExists {
+		t.Errorf("expected moving onto an existing file to fail with ErrExists, got: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("b.txt.tmp")}, [][]byte{[]byte("moved")}, true); err != datafs.ErrIsDirectory {
+		t.Errorf("expected replacing a directory to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("missing")}, [][]byte{[]byte("other")}, false); err != datafs.ErrNotExist {
+		t.Errorf("expected moving a missing file to fail with ErrNotExist, got: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("b.txt.tmp")}, [][]byte{[]byte("b.txt")}, true); err != nil {
+		t.Fatalf("failed to replace file: %v", err)
+	}
+
+	if got := read([]byte("b.txt")); got != "new content" {
+		t.Errorf("expected replaced file to have the new content, got: %s", got)
+	}
+
+	if f, err := fs.Open(os.O_RDONLY, []byte("b.txt")); err != nil || f.Ino() != tmp.Ino() {
+		t.Errorf("expected replaced file to be the moved inode, got: %v", err)
+	}
+
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if st := s.Stats(tx); st.Chunks != 2 {
+			t.Errorf("expected the chunks of the replaced file to be released, got: %+v", st)
+		}
+		return nil
+	})
+}
+
+func TestRenameReplaceOpen(t *testing.T) {
+	fs := testFileSystem(t)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte(name))
+		if err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+	}
+
+	src, dst := [][]byte{[]byte("a.txt")}, [][]byte{[]byte("b.txt")}
+	b, err := fs.OpenShared(os.O_RDWR, datafs.AccessRead|datafs.AccessWrite, datafs.AccessRead|datafs.AccessWrite, dst...)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if err = fs.Rename(src, dst, true); err != datafs.ErrSharingViolation {
+		t.Errorf("expected replacing a file that doesn't share deletion to fail with ErrSharingViolation, got: %v", err)
+	}
+
+	if err = b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if b, err = fs.Open(os.O_RDWR, dst...); err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if err = fs.Rename(src, dst, true); err != datafs.ErrAccessDenied {
+		t.Errorf("expected replacing an open file to fail with ErrAccessDenied, got: %v", err)
+	}
+
+	//the open handle is left intact
+	if _, err = b.Write(0, []byte("hello")); err != nil {
+		t.Errorf("expected the handle of the file that wasn't replaced to write, got: %v", err)
+	}
+
+	if err = b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Rename(src, dst, true); err != nil {
+		t.Errorf("expected a closed file to be replaced, got: %v", err)
+	}
+
+	//a link to a directory is replaced as a file
+	dir, err := fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir"))
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if err = dir.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Symlink([]byte("dir"), true, []byte("link")); err != nil {
+		t.Fatalf("failed to create directory link: %v", err)
+	}
+
+	if err = fs.Rename(dst, [][]byte{[]byte("link")}, true); err != nil {
+		t.Errorf("expected a directory link to be replaced, got: %v", err)
+	}
+
+	if _, err = fs.Readlink([]byte("link")); err != datafs.ErrNotSymlink {
+		t.Errorf("expected the link to be replaced by the file, got: %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	db := testdb(t)
+	fs, err := datafs.NewFileSystem(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir")); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("dir"), []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = f.Write(0, []byte("hello, world")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.CanRemove([]byte("dir")); err != datafs.ErrNotEmpty {
+		t.Errorf("expected removing a non-empty directory to fail with ErrNotEmpty, got: %v", err)
+	}
+
+	if err = fs.CanRemove(); err != datafs.ErrInvalidName {
+		t.Errorf("expected removing the root to fail with ErrInvalidName, got: %v", err)
+	}
+
+	if err = f.Metadata().SetFileAttributes(context.Background(), nil, dokan.FileAttributeReadonly); err != nil {
+		t.Fatalf("failed to set attributes: %v", err)
+	}
+
+	if err = fs.Remove([]byte("dir"), []byte("a.txt")); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected removing a read-only file to fail with ErrReadOnlyAttribute, got: %v", err)
+	}
+
+	if err = f.Metadata().SetFileAttributes(context.Background(), nil, dokan.FileAttributeNormal); err != nil {
+		t.Fatalf("failed to clear attributes: %v", err)
+	}
+
+	if err = fs.CanRemove([]byte("dir"), []byte("a.txt")); err != nil {
+		t.Errorf("expected file to be removable, got: %v", err)
+	}
+
+	if err = fs.Remove([]byte("dir"), []byte("a.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+
+	if err = fs.Remove([]byte("dir")); err != nil {
+		t.Fatalf("failed to remove empty directory: %v", err)
+	}
+
+	if ls, err := fs.List(); err != nil || len(ls) != 0 {
+		t.Errorf("expected root to be empty, got %d files (%v)", len(ls), err)
+	}
+
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if st := s.Stats(tx); st.Chunks != 0 {
+			t.Errorf("expected the chunks of the removed file to be released, got: %+v", st)
+		}
+		return nil
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	db := testdb(t)
+	fs := testBufferedFileSystem(t, db)
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	stats := func() (st datafs.ChunkStats) {
+		db.View(func(tx *bolt.Tx) error {
+			st = s.Stats(tx)
+			return nil
+		})
+		return st
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.bin"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	content := make([]byte, 128*1024)
+	rand.New(rand.NewSource(5)).Read(content)
+	if _, err = f.Write(0, content); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	size := int64(50000)
+	if err = f.Truncate(size); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+
+	if st := stats(); st.LogicalBytes != uint64(size) {
+		t.Errorf("expected only the remaining content to be stored, got: %+v", st)
+	}
+
+	before := stats()
+	if err = f.Truncate(1024 * 1024); err != nil {
+		t.Fatalf("failed to extend: %v", err)
+	}
+
+	if after := stats(); after != before {
+		t.Errorf("expected extending not to store chunks, before: %+v after: %+v", before, after)
+	}
+
+	expected := append(content[:size:size], make([]byte, 1024*1024-size)...)
+	buf := make([]byte, len(expected))
+	if n, err := f.Read(0, buf); err != nil || f.Size() != int64(len(expected)) || !bytes.Equal(buf[:n], expected) {
+		t.Errorf("expected truncated content followed by zeros, got %d bytes (%v)", n, err)
+	}
+
+	r, err := fs.Open(os.O_RDONLY, []byte("a.bin"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if err = r.Truncate(0); err != datafs.ErrReadOnly {
+		t.Errorf("expected truncating a read-only file to fail with ErrReadOnly, got: %v", err)
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	db := testdb(t)
+	fs := testBufferedFileSystem(t, db)
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	stats := func() (st datafs.ChunkStats) {
+		db.View(func(tx *bolt.Tx) error {
+			st = s.Stats(tx)
+			return nil
+		})
+		return st
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("disk.img"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	write := func(off int64, p []byte) {
+		if _, err := f.Write(off, p); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+
+		if err := f.Flush(); err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+	}
+
+	content := make([]byte, 10*1024*1024+5)
+	copy(content[10*1024*1024:], "hello")
+	write(10*1024*1024, []byte("hello"))
+	if st := stats(); st.LogicalBytes != 5 {
+		t.Errorf("expected a write beyond the end not to store the gap, got: %+v", st)
+	}
+
+	//zeros written explicitly are not stored either
+	write(0, make([]byte, 100*1024))
+	if st := stats(); st.LogicalBytes != 5 {
+		t.Errorf("expected zeros not to be stored, got: %+v", st)
+	}
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(6)).Read(data)
+	copy(content[1024*1024:], data)
+	write(1024*1024, data)
+	if st := stats(); st.LogicalBytes != uint64(len(data)+5) {
+		t.Errorf("expected only the written data to be stored, got: %+v", st)
+	}
+
+	buf := make([]byte, len(content))
+	if n, err := f.Read(0, buf); err != nil || !bytes.Equal(buf[:n], content) {
+		t.Errorf("expected holes to read as zeros, got %d bytes (%v)", n, err)
+	}
+
+	st, err := f.Metadata().GetFileInformation(context.Background(), nil)
+	if err != nil || st.FileAttributes&datafs.FileAttributeSparseFile == 0 {
+		t.Errorf("expected the sparse attribute to be reported, got: %x (%v)", st.FileAttributes, err)
+	}
+
+	//zeroing the data again releases its chunks
+	write(1024*1024, make([]byte, len(data)))
+	if st := stats(); st.LogicalBytes != 5 {
+		t.Errorf("expected zeroed data to be released, got: %+v", st)
+	}
+
+	d, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("dense.bin"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = d.Write(0, data); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if d.Metadata().Sparse() {
+		t.Errorf("expected a file without holes not to be sparse")
+	}
+}
+
+func TestByteRangeLocks(t *testing.T) {
+	fs := testFileSystem(t)
+	lm := fs.Locks()
+
+	a, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("db.sqlite"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = a.Write(0, make([]byte, 200)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = a.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	b, err := fs.Open(os.O_RDWR, []byte("db.sqlite"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	if err = lm.Lock(a, 0, 100, true); err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	if err = lm.Lock(b, 50, 100, false); err != datafs.ErrLockConflict {
+		t.Errorf("expected overlapping lock to fail with ErrLockConflict, got: %v", err)
+	}
+
+	if err = lm.Lock(b, 100, 100, false); err != nil {
+		t.Errorf("expected adjacent shared lock to succeed, got: %v", err)
+	}
+
+	if err = lm.Lock(a, 150, 10, false); err != nil {
+		t.Errorf("expected overlapping shared locks to succeed, got: %v", err)
+	}
+
+	if _, err = b.Read(10, make([]byte, 10)); err != datafs.ErrRangeLocked {
+		t.Errorf("expected read of an exclusively locked range to fail, got: %v", err)
+	}
+
+	if _, err = a.Write(10, []byte("x")); err != nil {
+		t.Errorf("expected the owner to write its exclusively locked range, got: %v", err)
+	}
+
+	if _, err = a.Write(150, []byte("x")); err != datafs.ErrRangeLocked {
+		t.Errorf("expected write to a shared locked range to fail, got: %v", err)
+	}
+
+	if n := len(lm.Locks(a.Ino())); n != 3 {
+		t.Errorf("expected 3 locks, got: %d", n)
+	}
+
+	if err = lm.Unlock(b, 100, 50); err != datafs.ErrNotLocked {
+		t.Errorf("expected unlocking a different range to fail with ErrNotLocked, got: %v", err)
+	}
+
+	if err = lm.Unlock(b, 100, 100); err != nil {
+		t.Errorf("failed to unlock: %v", err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if n := len(lm.Locks(a.Ino())); n != 0 {
+		t.Errorf("expected closing to release all locks, got: %d", n)
+	}
+
+	if _, err = b.Read(10, make([]byte, 10)); err != nil {
+		t.Errorf("expected read to succeed after the lock was released, got: %v", err)
+	}
+}
+
+func TestShareModes(t *testing.T) {
+	fs := testFileSystem(t)
+
+	a, err := fs.OpenShared(os.O_RDWR|os.O_CREATE, datafs.AccessRead|datafs.AccessWrite, datafs.AccessRead, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	r, err := fs.OpenShared(os.O_RDONLY, datafs.AccessRead, datafs.AccessAll, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("expected a reader to share with the writer, got: %v", err)
+	}
+
+	if _, err = fs.OpenShared(os.O_RDWR, datafs.AccessRead|datafs.AccessWrite, datafs.AccessAll, []byte("a.txt")); err != datafs.ErrSharingViolation {
+		t.Errorf("expected a second writer to fail with ErrSharingViolation, got: %v", err)
+	}
+
+	if _, err = fs.OpenShared(os.O_RDONLY, datafs.AccessRead, datafs.AccessRead, []byte("a.txt")); err != datafs.ErrSharingViolation {
+		t.Errorf("expected a reader that doesn't share writing to fail with ErrSharingViolation, got: %v", err)
+	}
+
+	//handles of the same file see each others committed writes
+	if _, err = a.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = a.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if n, err := r.Read(0, buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("expected other handle to read the written content, got: %q (%v)", buf[:n], err)
+	}
+
+	w, err := fs.OpenShared(os.O_RDWR, datafs.AccessRead|datafs.AccessWrite|datafs.AccessDelete, datafs.AccessAll, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("expected writer to open after the other was closed, got: %v", err)
+	}
+
+	if err = w.RemoveOnClose([]byte("a.txt")); err != nil {
+		t.Fatalf("failed to mark for removal: %v", err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY, []byte("a.txt")); err != datafs.ErrDeletePending {
+		t.Errorf("expected opening a file with pending removal to fail with ErrDeletePending, got: %v", err)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY, []byte("a.txt")); err != datafs.ErrNotExist {
+		t.Errorf("expected the file to be removed when its last handle closed, got: %v", err)
+	}
+
+	//a removal that is skipped because the file was moved keeps its writes
+	w, err = fs.OpenShared(os.O_RDWR|os.O_CREATE, datafs.AccessAll, datafs.AccessAll, []byte("b.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = w.Write(0, []byte("moved")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = w.RemoveOnClose([]byte("b.txt")); err != nil {
+		t.Fatalf("failed to mark for removal: %v", err)
+	}
+
+	if err = fs.Rename([][]byte{[]byte("b.txt")}, [][]byte{[]byte("c.txt")}, false); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if r, err = fs.Open(os.O_RDONLY, []byte("c.txt")); err != nil {
+		t.Fatalf("expected the moved file not to be removed, got: %v", err)
+	}
+
+	if n, err := r.Read(0, buf); err != nil || string(buf[:n]) != "moved" {
+		t.Errorf("expected the moved file to keep its buffered writes, got: %q (%v)", buf[:n], err)
+	}
+
+	//listing a directory doesn't keep a handle of it open
+	d, err := fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir"))
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if err = d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if _, err = fs.List([]byte("dir")); err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+
+	if d, err = fs.Open(os.O_RDONLY|datafs.O_DIRECTORY, []byte("dir")); err != nil {
+		t.Fatalf("failed to open directory: %v", err)
+	}
+
+	if err = d.RemoveOnClose([]byte("dir")); err != nil {
+		t.Fatalf("failed to mark for removal: %v", err)
+	}
+
+	if err = d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY, []byte("dir")); err != datafs.ErrNotExist {
+		t.Errorf("expected the listed directory to be removed when its handle closed, got: %v", err)
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	sid, err := datafs.ParseSID("S-1-5-21-1004-513")
+	if err != nil || sid.String() != "S-1-5-21-1004-513" {
+		t.Errorf("expected SID to round-trip through its string form, got: %v (%v)", sid, err)
+	}
+
+	if _, err = datafs.ParseSID("S-1-x"); err == nil {
+		t.Errorf("expected malformed SID to fail to parse")
+	}
+
+	if sid = datafs.UnixUserSID(1000); sid.String() != "S-1-22-1-1000" {
+		t.Errorf("expected uid to map into the Unix user authority, got: %v", sid)
+	}
+
+	uid, gid, mode := datafs.UnixSecurity(1000, 100, 0750).Unix()
+	if uid != 1000 || gid != 100 || mode != 0750 {
+		t.Errorf("expected ownership to round-trip, got: %d %d %v", uid, gid, mode)
+	}
+
+	sec := &datafs.Security{Owner: datafs.MustParseSID("S-1-5-32-544")}
+	if uid, gid, mode = sec.Unix(); uid != datafs.UnixNobody || gid != datafs.UnixNobody || mode != 0777 {
+		t.Errorf("expected non-Unix owner without entries to be nobody with full access, got: %d %d %v", uid, gid, mode)
+	}
+
+	fs := testFileSystem(t)
+	dir, err := fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("team"))
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if err = dir.SetSecurity(&datafs.Security{Owner: datafs.SID{1, 2}}); err != datafs.ErrInvalidSID {
+		t.Errorf("expected malformed SID to fail with ErrInvalidSID, got: %v", err)
+	}
+
+	if err = dir.SetSecurity(datafs.UnixSecurity(1000, 100, 0770)); err != nil {
+		t.Fatalf("failed to set security: %v", err)
+	}
+
+	if err = dir.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	//files inherit the access control of the directory they are created in
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("team"), []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if uid, gid, mode = f.Metadata().Security.Unix(); uid != 1000 || gid != 100 || mode != 0770 {
+		t.Errorf("expected file to inherit the directory's security, got: %d %d %v", uid, gid, mode)
+	}
+
+	data, err := json.Marshal(f.Metadata().Security)
+	if err != nil || !strings.Contains(string(data), `"S-1-22-1-1000"`) {
+		t.Errorf("expected SIDs to be stored in their string form, got: %s (%v)", data, err)
+	}
+
+	buf := make([]byte, 256)
+	sd := winacl.NewSecurityDescriptorWithBuffer(buf)
+	if err = f.Metadata().GetFileSecurity(context.Background(), nil, winacl.OwnerSecurityInformation|winacl.DACLSecurityInformation, sd); err != nil || sd.HasOverflowed() {
+		t.Fatalf("failed to get security descriptor: %v", err)
+	}
+
+	owner := binary.LittleEndian.Uint32(buf[4:])
+	if owner == 0 || !bytes.Equal(buf[owner:owner+16], datafs.UnixUserSID(1000)) {
+		t.Errorf("expected descriptor to hold the owner SID, got offset %d", owner)
+	}
+
+	if group := binary.LittleEndian.Uint32(buf[8:]); group != 0 {
+		t.Errorf("expected group to be left out when not requested, got offset %d", group)
+	}
+
+	if dacl := binary.LittleEndian.Uint32(buf[16:]); dacl == 0 || binary.LittleEndian.Uint16(buf[dacl+4:]) != 3 {
+		t.Errorf("expected descriptor to hold a DACL with 3 entries, got offset %d", dacl)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	fs := testFileSystem(t)
+	if _, err := fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("lib")); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if _, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("lib"), []byte("a.txt")); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if err := fs.Symlink([]byte("../lib"), true, []byte("venv")); err != nil {
+		t.Fatalf("failed to create directory link: %v", err)
+	}
+
+	if err := fs.Symlink([]byte("/venv/a.txt"), false, []byte("a.lnk")); err != nil {
+		t.Fatalf("failed to create file link: %v", err)
+	}
+
+	if err := fs.Symlink([]byte("x"), false, []byte("a.lnk")); err != datafs.ErrExists {
+		t.Errorf("expected creating an existing link to fail with ErrExists, got: %v", err)
+	}
+
+	if target, err := fs.Readlink([]byte("venv")); err != nil || string(target) != "../lib" {
+		t.Errorf("expected link target '../lib', got: %q (%v)", target, err)
+	}
+
+	if _, err := fs.Readlink([]byte("lib")); err != datafs.ErrNotSymlink {
+		t.Errorf("expected reading a directory as link to fail with ErrNotSymlink, got: %v", err)
+	}
+
+	resolved, err := fs.EvalSymlinks([]byte("a.lnk"))
+	if err != nil || string(bytes.Join(resolved, []byte("/"))) != "lib/a.txt" {
+		t.Errorf("expected link chain to resolve to 'lib/a.txt', got: %q (%v)", resolved, err)
+	}
+
+	if _, err = fs.EvalSymlinks([]byte("venv"), []byte("b.txt")); err != datafs.ErrNotExist {
+		t.Errorf("expected evaluating a missing file to fail with ErrNotExist, got: %v", err)
+	}
+
+	//files are opened and created through the links as dokan does
+	for _, p := range [][][]byte{{[]byte("a.lnk")}, {[]byte("venv"), []byte("b.txt")}} {
+		resolved, err = fs.FollowSymlinks(p...)
+		if err != nil {
+			t.Fatalf("failed to follow links of '%s': %v", bytes.Join(p, []byte("/")), err)
+		}
+
+		f, err := fs.Open(os.O_RDWR|os.O_CREATE, resolved...)
+		if err != nil {
+			t.Fatalf("failed to open '%s' through a link: %v", bytes.Join(p, []byte("/")), err)
+		}
+
+		if _, err = f.Write(0, []byte("linked")); err != nil {
+			t.Fatalf("failed to write through a link: %v", err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+	}
+
+	buf := make([]byte, 10)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		f, err := fs.Open(os.O_RDONLY, []byte("lib"), []byte(name))
+		if err != nil {
+			t.Fatalf("expected '%s' to be written through a link, got: %v", name, err)
+		}
+
+		if n, err := f.Read(0, buf); err != io.EOF || string(buf[:n]) != "linked" {
+			t.Errorf("expected to read the content written through a link, got: %q (%v)", buf[:n], err)
+		}
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE, []byte("venv"), []byte("c.txt")); err != datafs.ErrNotDirectory {
+		t.Errorf("expected creating inside a directory link to fail with ErrNotDirectory, got: %v", err)
+	}
+
+	if err = fs.Symlink([]byte("loop"), false, []byte("loop")); err != nil {
+		t.Fatalf("failed to create link: %v", err)
+	}
+
+	if _, err = fs.EvalSymlinks([]byte("loop")); err != datafs.ErrTooManyLinks {
+		t.Errorf("expected a link loop to fail with ErrTooManyLinks, got: %v", err)
+	}
+
+	ls, err := fs.List()
+	if err != nil {
+		t.Fatalf("failed to list root: %v", err)
+	}
+
+	for _, f := range ls {
+		st, _ := f.Metadata().GetFileInformation(context.Background(), nil)
+		isLink := string(f.Name()) != "lib"
+		if isLink != (st.ReparsePointTag == dokan.IOReparseTagSymlink) || isLink != (st.FileAttributes&dokan.FileAttributeReparsePoint != 0) {
+			t.Errorf("unexpected reparse information for '%s': %+v", f.Name(), st)
+		}
+
+		if string(f.Name()) == "venv" && st.FileAttributes&dokan.FileAttributeDirectory == 0 {
+			t.Errorf("expected directory link to have the directory attribute, got: %x", st.FileAttributes)
+		}
+	}
+
+	if err = fs.Remove([]byte("venv")); err != nil {
+		t.Errorf("expected directory link to be removable, got: %v", err)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	db := testdb(t)
+	fs, err := datafs.NewFileSystem(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = f.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY|os.O_CREATE|datafs.O_DIRECTORY, []byte("dir")); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if err = fs.Link([][]byte{[]byte("a.txt")}, [][]byte{[]byte("dir"), []byte("b.txt")}); err != nil {
+		t.Fatalf("failed to link: %v", err)
+	}
+
+	if err = fs.Link([][]byte{[]byte("a.txt")}, [][]byte{[]byte("dir"), []byte("b.txt")}); err != datafs.ErrExists {
+		t.Errorf("expected linking onto an existing entry to fail with ErrExists, got: %v", err)
+	}
+
+	if err = fs.Link([][]byte{[]byte("dir")}, [][]byte{[]byte("dir2")}); err != datafs.ErrIsDirectory {
+		t.Errorf("expected linking a directory to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	b, err := fs.Open(os.O_RDONLY, []byte("dir"), []byte("b.txt"))
+	if err != nil || b.Ino() != f.Ino() {
+		t.Fatalf("expected link to open the same inode, got: %v", err)
+	}
+
+	if st, _ := f.Metadata().GetFileInformation(context.Background(), nil); st.NumberOfLinks != 2 {
+		t.Errorf("expected open handle to report 2 links, got: %d", st.NumberOfLinks)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Remove([]byte("a.txt")); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+
+	if st, _ := b.Metadata().GetFileInformation(context.Background(), nil); st.NumberOfLinks != 1 {
+		t.Errorf("expected 1 link after removing the other, got: %d", st.NumberOfLinks)
+	}
+
+	buf := make([]byte, 5)
+	if n, err := b.Read(0, buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("expected content to survive removal of a link, got: %q (%v)", buf[:n], err)
+	}
+
+	if err = b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Remove([]byte("dir"), []byte("b.txt")); err != nil {
+		t.Fatalf("failed to remove last link: %v", err)
+	}
+
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if st := s.Stats(tx); st.Chunks != 0 {
+			t.Errorf("expected the chunks to be released with the last link, got: %+v", st)
+		}
+		return nil
+	})
+}
+
+func TestXattrs(t *testing.T) {
+	db := testdb(t)
+	fs := testBufferedFileSystem(t, db)
+	_, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = fs.Xattr([]byte("user.dataset.origin"), []byte("a.txt")); err != datafs.ErrNoXattr {
+		t.Errorf("expected missing attribute to fail with ErrNoXattr, got: %v", err)
+	}
+
+	if err = fs.SetXattr([]byte("a:b"), nil, []byte("a.txt")); err != datafs.ErrInvalidName {
+		t.Errorf("expected name with a stream separator to fail with ErrInvalidName, got: %v", err)
+	}
+
+	if err = fs.SetXattr([]byte("user.dataset.origin"), []byte("s3://bucket"), []byte("a.txt")); err != nil {
+		t.Fatalf("failed to set attribute: %v", err)
+	}
+
+	large := make([]byte, 100*1024)
+	rand.New(rand.NewSource(5)).Read(large)
+	if err = fs.SetXattr([]byte("Zone.Identifier"), large, []byte("a.txt")); err != nil {
+		t.Fatalf("failed to set large attribute: %v", err)
+	}
+
+	//renames keep the attributes and collection keeps their chunks
+	if err = fs.Rename([][]byte{[]byte("a.txt")}, [][]byte{[]byte("b.txt")}, false); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+
+	if _, err = fs.CollectGarbage(); err != nil {
+		t.Fatalf("failed to collect garbage: %v", err)
+	}
+
+	if v, err := fs.Xattr([]byte("Zone.Identifier"), []byte("b.txt")); err != nil || !bytes.Equal(v, large) {
+		t.Errorf("expected large attribute to round-trip, got %d bytes (%v)", len(v), err)
+	}
+
+	names, err := fs.Xattrs([]byte("b.txt"))
+	if err != nil || string(bytes.Join(names, []byte(","))) != "Zone.Identifier,user.dataset.origin" {
+		t.Errorf("unexpected attribute names: %q (%v)", names, err)
+	}
+
+	if err = fs.RemoveXattr([]byte("user.dataset.origin"), []byte("b.txt")); err != nil {
+		t.Fatalf("failed to remove attribute: %v", err)
+	}
+
+	if err = fs.Remove([]byte("b.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+
+	s, err := datafs.NewChunkStore(db, nil)
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if st := s.Stats(tx); st.Chunks != 0 {
+			t.Errorf("expected the chunks of the attributes to be released with the file, got: %+v", st)
+		}
+		return nil
+	})
+}
+
+func TestStreams(t *testing.T) {
+	fs := testFileSystem(t)
+	name := []byte("Zone.Identifier")
+	if _, err := fs.OpenStream(os.O_RDWR, datafs.AccessAll, datafs.AccessAll, name, []byte("a.txt")); err != datafs.ErrNotExist {
+		t.Errorf("expected opening a stream of a missing file to fail with ErrNotExist, got: %v", err)
+	}
+
+	//creating the stream creates its file, like NTFS does
+	s1, err := fs.OpenStream(os.O_RDWR|os.O_CREATE, datafs.AccessRead|datafs.AccessWrite, datafs.AccessRead|datafs.AccessWrite, name, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+
+	f, err := fs.Open(os.O_RDONLY, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("expected the file of the stream to be created, got: %v", err)
+	}
+
+	if meta, err := s1.Stat(); err != nil || !meta.Modified.Equal(f.ModTime()) {
+		t.Errorf("expected the stream to report the times of its file, got: %v (%v)", meta, err)
+	}
+
+	if _, err = fs.OpenStream(os.O_RDONLY, datafs.AccessRead, datafs.AccessRead, name, []byte("a.txt")); err != datafs.ErrSharingViolation {
+		t.Errorf("expected opening without sharing writes to fail with ErrSharingViolation, got: %v", err)
+	}
+
+	s2, err := fs.OpenStream(os.O_RDWR, datafs.AccessRead|datafs.AccessWrite, datafs.AccessRead|datafs.AccessWrite, name, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	//the handles share the value, so closing one doesn't undo the other's writes
+	if _, err = s1.Write(0, []byte("[ZoneTransfer]")); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+
+	buf := make([]byte, 14)
+	if n, err := s2.Read(0, buf); err != nil || string(buf[:n]) != "[ZoneTransfer]" {
+		t.Errorf("expected the write of another handle, got: %q (%v)", buf[:n], err)
+	}
+
+	if err = s1.Lock(0, 4, true); err != nil {
+		t.Fatalf("failed to lock stream: %v", err)
+	}
+
+	if _, err = s2.Write(0, []byte("x")); err != datafs.ErrRangeLocked {
+		t.Errorf("expected writing a range locked by another handle to fail with ErrRangeLocked, got: %v", err)
+	}
+
+	if err = s1.Close(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+
+	if _, err = s2.Write(0, []byte("[")); err != nil {
+		t.Errorf("expected the locks to be released on close, got: %v", err)
+	}
+
+	if v, err := fs.Xattr(name, []byte("a.txt")); err != nil || string(v) != "[ZoneTransfer]" {
+		t.Errorf("expected the stream to be stored on close, got: %q (%v)", v, err)
+	}
+
+	s2.RemoveOnClose()
+	if _, err = fs.OpenStream(os.O_RDONLY, datafs.AccessRead, datafs.AccessAll, name, []byte("a.txt")); err != datafs.ErrDeletePending {
+		t.Errorf("expected opening a stream that is about to be removed to fail with ErrDeletePending, got: %v", err)
+	}
+
+	if err = s2.Close(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+
+	if _, err = fs.Xattr(name, []byte("a.txt")); err != datafs.ErrNoXattr {
+		t.Errorf("expected the stream to be removed with its last handle, got: %v", err)
+	}
+}
+
+func TestStreamAccess(t *testing.T) {
+	fs := testFileSystem(t)
+	name := []byte("Zone.Identifier")
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if err = fs.SetXattr(name, []byte("[ZoneTransfer]"), []byte("a.txt")); err != nil {
+		t.Fatalf("failed to set attribute: %v", err)
+	}
+
+	if _, err = fs.OpenStream(os.O_RDONLY|os.O_TRUNC, datafs.AccessRead, datafs.AccessAll, name, []byte("a.txt")); err != datafs.ErrReadOnly {
+		t.Errorf("expected truncating a read-only stream to fail with ErrReadOnly, got: %v", err)
+	}
+
+	s, err := fs.OpenStream(os.O_RDONLY, datafs.AccessRead, datafs.AccessAll, name, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	if _, err = s.Write(0, []byte("XX")); err != datafs.ErrReadOnly {
+		t.Errorf("expected writing a stream opened read-only to fail with ErrReadOnly, got: %v", err)
+	}
+
+	if err = s.Truncate(0); err != datafs.ErrReadOnly {
+		t.Errorf("expected truncating a stream opened read-only to fail with ErrReadOnly, got: %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+
+	s, err = fs.OpenStream(os.O_RDWR, datafs.AccessRead|datafs.AccessWrite, datafs.AccessAll, name, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	if err = f.Metadata().SetFileAttributes(context.Background(), nil, dokan.FileAttributeReadonly); err != nil {
+		t.Fatalf("failed to set attributes: %v", err)
+	}
+
+	if _, err = s.Write(0, []byte("XX")); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected writing a stream of a read-only file to fail with ErrReadOnlyAttribute, got: %v", err)
+	}
+
+	if err = s.CanRemove(); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected removing a stream of a read-only file to fail with ErrReadOnlyAttribute, got: %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+
+	if _, err = fs.OpenStream(os.O_RDWR, datafs.AccessRead|datafs.AccessWrite, datafs.AccessAll, name, []byte("a.txt")); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected opening a stream of a read-only file for writing to fail with ErrReadOnlyAttribute, got: %v", err)
+	}
+
+	if _, err = fs.OpenStream(os.O_RDONLY|os.O_CREATE, datafs.AccessRead, datafs.AccessAll, []byte("other"), []byte("a.txt")); err != datafs.ErrReadOnlyAttribute {
+		t.Errorf("expected creating a stream of a read-only file to fail with ErrReadOnlyAttribute, got: %v", err)
+	}
+
+	if v, err := fs.Xattr(name, []byte("a.txt")); err != nil || string(v) != "[ZoneTransfer]" {
+		t.Errorf("expected the stream to be unchanged, got: %q (%v)", v, err)
+	}
+
+	//deleting a stream goes through CanRemove and a removal on close
+	if err = f.Metadata().SetFileAttributes(context.Background(), nil, dokan.FileAttributeNormal); err != nil {
+		t.Fatalf("failed to set attributes: %v", err)
+	}
+
+	s, err = fs.OpenStream(os.O_RDONLY, datafs.AccessRead|datafs.AccessDelete, datafs.AccessAll, name, []byte("a.txt"))
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	if err = s.CanRemove(); err != nil {
+		t.Fatalf("expected stream to be removable, got: %v", err)
+	}
+
+	s.RemoveOnClose()
+	if err = s.Close(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+
+	if _, err = fs.Xattr(name, []byte("a.txt")); err != datafs.ErrNoXattr {
+		t.Errorf("expected the stream to be deleted, got: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDONLY, []byte("a.txt")); err != nil {
+		t.Errorf("expected deleting the stream to leave its file, got: %v", err)
+	}
+}
+
+func TestXattrEncryption(t *testing.T) {
+	db := testdb(t)
+	fs, err := datafs.NewFileSystem(db, &datafs.Options{
+		Chunking: testChunkerConfig,
+		Secret:   []byte("correct horse battery staple"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create file system: %v", err)
+	}
+
+	if _, err = fs.Open(os.O_RDWR|os.O_CREATE, []byte("a.txt")); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	value := []byte("s3://secret-customer-bucket")
+	if err = fs.SetXattr([]byte("user.dataset.origin"), value, []byte("a.txt")); err != nil {
+		t.Fatalf("failed to set attribute: %v", err)
+	}
+
+	if err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(datafs.BucketNameXattrs).ForEach(func(k, v []byte) error {
+			x := struct {
+				V []byte `json:"v"`
+			}{}
+
+			if err := json.Unmarshal(v, &x); err != nil {
+				return err
+			}
+
+			if bytes.Contains(v, value) || bytes.Contains(x.V, value) {
+				t.Errorf("expected small attribute value to be stored encrypted, got record: %s", v)
+			}
+
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := fs.Xattr([]byte("user.dataset.origin"), []byte("a.txt")); err != nil || !bytes.Equal(v, value) {
+		t.Errorf("expected attribute to decrypt to its value, got: %q (%v)", v, err)
+	}
+}
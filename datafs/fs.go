@@ -1,8 +1,17 @@
 package datafs
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 var (
@@ -12,16 +21,59 @@ var (
 	//ErrNotExist is returned when there is no file while it is expected
 	ErrNotExist = errors.New("No such file or directory")
 
+	//ErrPathNotFound is returned when a directory in the path to a file doesn't exist
+	ErrPathNotFound = errors.New("No such directory in path")
+
 	//ErrNotDirectory is returned when the file is not a directory while it is expected to
 	ErrNotDirectory = errors.New("Not a directory")
+
+	//ErrIsDirectory is returned when a directory is opened for writing
+	ErrIsDirectory = errors.New("Is a directory")
+
+	//ErrReadOnly is returned when modifying a file that was opened read-only
+	ErrReadOnly = errors.New("File is opened read-only")
+
+	//ErrInvalidName is returned when a path element cannot be used as a file name
+	ErrInvalidName = errors.New("Invalid file name")
+
+	//ErrReadOnlyAttribute is returned when modifying a file that has the read-only attribute
+	ErrReadOnlyAttribute = errors.New("File has the read-only attribute")
+
+	//ErrInvalidMove is returned when moving a directory into itself or one of its descendants
+	ErrInvalidMove = errors.New("Cannot move a directory into itself")
+
+	//ErrNotEmpty is returned when removing a directory that still has entries
+	ErrNotEmpty = errors.New("Directory not empty")
+
+	//ErrTooManyHardLinks is returned when a file cannot be given another hard link
+	ErrTooManyHardLinks = errors.New("Too many hard links")
+
+	//ErrAccessDenied is returned when replacing a file that is still open
+	ErrAccessDenied = errors.New("Access denied")
 )
 
 var (
-	//BucketNameFiles refers to the bucket that holds file (metadata)
+	//BucketNameFiles refers to the bucket that holds file (metadata) by inode number
 	BucketNameFiles = []byte("files")
 
+	//BucketNameDirents refers to the bucket that maps directory entries to inode numbers
+	BucketNameDirents = []byte("dirents")
+
 	//BucketNameChunks refers to the bucket that holds file contents
 	BucketNameChunks = []byte("chunks")
+
+	//BucketNameVolume refers to the bucket that holds volume wide settings
+	BucketNameVolume = []byte("volume")
+)
+
+//Flags to Open in addition to the os.O_* flags
+const (
+	//O_DIRECTORY requires the file to be a directory, combined with
+	//os.O_CREATE a directory is created if it doesn't exist
+	O_DIRECTORY = 1 << 24
+
+	//O_NOTDIRECTORY requires the file not to be a directory
+	O_NOTDIRECTORY = 1 << 25
 )
 
 //FileSystem maps file system semantics unto the bolt db buckets that
@@ -36,7 +88,79 @@ var (
 //     * Attr(ctx context.Context, a *fuse.Attr) error
 //     * ReadDirAll(ctx context.Context) ([]fuse.Dirent, error)
 //     * Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
-type FileSystem struct{}
+type FileSystem struct {
+	db      *bolt.DB
+	opts    Options
+	chunks  *ChunkStore
+	locks   *LockManager
+	handles *handleTable
+	streams *streamTable
+}
+
+//Options configure how a file system stores its content
+type Options struct {
+	//Chunking determines the sizes in which file content is split
+	Chunking ChunkerConfig
+
+	//WriteBufferSize is the number of bytes written to an opened file before
+	//they are chunked and committed to the database
+	WriteBufferSize int
+
+	//WriteBufferAge is the time after which buffered writes are committed,
+	//also when the file is left open without writing to it again
+	WriteBufferAge time.Duration
+
+	//Hash keys the chunks of new volumes, existing volumes keep the
+	//algorithm they were created with
+	Hash Hash
+
+	//Compression encodes new chunks, chunks that don't compress are stored
+	//raw regardless
+	Compression Codec
+
+	//Secret is the passphrase or key file content that encrypts the volume,
+	//it is required to open an encrypted volume and a new volume is only
+	//encrypted when it is provided
+	Secret []byte
+}
+
+//DefaultOptions are used when no options are provided
+var DefaultOptions = &Options{
+	Chunking:        DefaultChunkerConfig,
+	WriteBufferSize: 64 * 1024 * 1024,
+	WriteBufferAge:  5 * time.Second,
+	Hash:            SHA256,
+	Compression:     CodecRaw,
+}
+
+//NewFileSystem sets up the buckets and root directory of a file system
+//in the provided database, if 'opts' is nil the DefaultOptions are used
+func NewFileSystem(db *bolt.DB, opts *Options) (fs *FileSystem, err error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+
+	if err = opts.Chunking.Validate(); err != nil {
+		return nil, err
+	}
+
+	fs = &FileSystem{db: db, opts: *opts, locks: NewLockManager(), handles: newHandleTable(), streams: newStreamTable()}
+	fs.chunks, err = NewChunkStore(db, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup chunk store: %v", err)
+	}
+
+	if err = fs.db.Update(setupInodes); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+//Locks returns the manager of the byte-range locks on opened files
+func (fs *FileSystem) Locks() *LockManager {
+	return fs.locks
+}
 
 //File are hold the metadata information for a path in the fileystem
 //tree. It may be a directory (under the prefix of some other files)
@@ -47,34 +171,1089 @@ type FileSystem struct{}
 // - On Linux (or OSX) Fuse it is modelled for:
 //     * Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error
 //     * Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
-type File struct{}
+type File struct {
+	fs     *FileSystem
+	ino    uint64
+	path   []byte
+	flag   int
+	access Access
+	share  Access
+	meta   *BoltFile
+	open   *openFile //state shared with the other handles of the file
+}
+
+//IsDir returns whether the file is a directory
+func (f *File) IsDir() bool {
+	f.lock()
+	defer f.unlock()
+	return f.meta.IsDirectory
+}
+
+//Ino returns the inode number of the file, it uniquely identifies the file
+//in the volume for as long as it exists, also when it is renamed
+func (f *File) Ino() uint64 {
+	return f.ino
+}
+
+//lock serializes the access to the buffered writes and metadata of the
+//file, dokan calls back from several threads at once. The lock is shared
+//by all handles of the file and must be taken before any transaction.
+func (f *File) lock() {
+	f.open.mu.Lock()
+}
+
+func (f *File) unlock() {
+	f.open.mu.Unlock()
+}
+
+//update replaces the file's metadata with a newer version in place, the
+//dokan representation of the file shares it and so do other handles of
+//the same file. The caller holds the lock of the file.
+func (f *File) update(meta *BoltFile) {
+	f.meta.set(meta)
+	f.fs.handles.each(f.ino, func(h *File) {
+		if h != f {
+			h.meta.set(meta)
+		}
+	})
+}
+
+//Name returns the name of the file in its directory, it is empty for the root
+func (f *File) Name() []byte {
+	return f.path[bytes.LastIndexByte(f.path, '/')+1:]
+}
+
+//Readdir returns the files in the directory that match Windows wildcard
+//'pattern', a nil pattern returns all of them. Only the directory entries
+//that start with the literal prefix of the pattern are iterated.
+func (f *File) Readdir(pattern []byte) (ls []*File, err error) {
+	if !f.IsDir() {
+		return nil, ErrNotDirectory
+	}
+
+	if err = f.fs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketNameFiles)
+		dirKey := inoKey(f.ino)
+		prefix := append(dirKey, patternPrefix(pattern)...)
+		c := tx.Bucket(BucketNameDirents).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			name := k[len(dirKey):]
+			if !matchPattern(pattern, name) {
+				continue
+			}
+
+			ino := binary.BigEndian.Uint64(v)
+			meta, err := LoadBoltFile(b, ino)
+			if err != nil {
+				return fmt.Errorf("failed to load '%s': %v", childPath(f.path, name), err)
+			}
 
-//Read will get bytes from a file's chunked content and place then into buffer 'buf'
+			meta.file = &File{fs: f.fs, ino: ino, path: childPath(f.path, name), meta: meta, open: f.fs.handles.opened(ino)}
+			ls = append(ls, meta.file)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return ls, nil
+}
+
+//Metadata returns the persisted metadata of the file, it is shared with the
+//file and updated when buffered writes are committed
+func (f *File) Metadata() *BoltFile {
+	return boltFile(f)
+}
+
+//ModTime returns the time the file's content was last written, including
+//buffered writes
+func (f *File) ModTime() time.Time {
+	f.lock()
+	defer f.unlock()
+	return f.modTime()
+}
+
+func (f *File) modTime() time.Time {
+	if !f.open.buf.empty() {
+		return f.open.buf.last
+	}
+
+	return f.meta.Modified
+}
+
+//Size returns the size of the file's content, including buffered writes
+func (f *File) Size() int64 {
+	f.lock()
+	defer f.unlock()
+	return f.size()
+}
+
+func (f *File) size() int64 {
+	if end := f.open.buf.end(); end > f.meta.Size {
+		return end
+	}
+
+	return f.meta.Size
+}
+
+//readCommitted reads the content at 'offset' from the chunks in 'refs'
+//into 'p', bytes that are not covered by a chunk read as zeros
+func (f *File) readCommitted(tx *bolt.Tx, refs []ChunkRef, offset int64, p []byte) error {
+	for i := range p {
+		p[i] = 0
+	}
+
+	end := offset + int64(len(p))
+	for i := chunkIndex(refs, offset); i < len(refs) && refs[i].Offset < end; i++ {
+		ref := refs[i]
+		if ref.IsHole() {
+			continue
+		}
+
+		c, err := f.fs.chunks.Get(tx, ref.K)
+		if err != nil {
+			return fmt.Errorf("failed to get chunk '%s' of '%s': %v", ref.K, f.path, err)
+		}
+
+		if ref.Offset >= offset {
+			copy(p[ref.Offset-offset:], c)
+		} else {
+			copy(p, c[offset-ref.Offset:])
+		}
+	}
+
+	return nil
+}
+
+//Read will get bytes from a file's chunked content and place then into buffer 'buf',
+//like io.ReaderAt it returns io.EOF when the end of the file is reached before
+//'buf' is filled
 func (f *File) Read(offset int64, buf []byte) (n int, err error) {
-	return 0, nil
+	if offset < 0 {
+		return 0, fmt.Errorf("negative read offset %d", offset)
+	}
+
+	f.lock()
+	defer f.unlock()
+	size := f.size()
+	if offset >= size {
+		return 0, io.EOF
+	}
+
+	p := buf
+	if int64(len(p)) > size-offset {
+		p = p[:size-offset]
+	}
+
+	if err = f.fs.locks.check(f, offset, int64(len(p)), false); err != nil {
+		return 0, err
+	}
+
+	if err = f.fs.db.View(func(tx *bolt.Tx) error {
+		return f.readCommitted(tx, f.meta.Chunks, offset, p)
+	}); err != nil {
+		return 0, err
+	}
+
+	f.open.buf.overlay(offset, p)
+	if len(p) < len(buf) {
+		return len(p), io.EOF
+	}
+
+	return len(p), nil
 }
 
-//Write will put bytes a file's chunked content from buffer 'buf'
-//@TODO how do we deal with buffering before chunking chunking?
+//Write will put bytes a file's chunked content from buffer 'buf', writes are
+//buffered and only chunked when the file is flushed or when the buffer
+//exceeds the configured size or age. If the file was opened with
+//os.O_APPEND the offset is ignored and 'buf' is written at the end.
 func (f *File) Write(offset int64, buf []byte) (n int, err error) {
-	return 0, nil
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, ErrReadOnly
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative write offset %d", offset)
+	}
+
+	f.lock()
+	defer f.unlock()
+	if f.meta.ReadOnly() {
+		return 0, ErrReadOnlyAttribute
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		offset = f.size()
+	}
+
+	if err = f.fs.locks.check(f, offset, int64(len(buf)), true); err != nil {
+		return 0, err
+	}
+
+	f.open.buf.write(offset, buf)
+	if f.open.buf.n >= f.fs.opts.WriteBufferSize || time.Since(f.open.buf.since) >= f.fs.opts.WriteBufferAge {
+		if err = f.flush(); err != nil {
+			return 0, err
+		}
+	} else if f.open.timer == nil {
+		f.open.timer = time.AfterFunc(f.fs.opts.WriteBufferAge, f.flushAged)
+	}
+
+	return len(buf), nil
+}
+
+//flushAged commits the buffered writes once the oldest reached the
+//configured age, it runs on a timer such that the writes to a file that is
+//left open don't stay in memory only. If the writes were committed and
+//buffered again in the meantime the timer is set for the newer writes.
+func (f *File) flushAged() {
+	f.lock()
+	defer f.unlock()
+	f.open.timer = nil
+	if f.open.buf.empty() {
+		return
+	}
+
+	if age := time.Since(f.open.buf.since); age < f.fs.opts.WriteBufferAge {
+		f.open.timer = time.AfterFunc(f.fs.opts.WriteBufferAge-age, f.flushAged)
+		return
+	}
+
+	if err := f.flush(); err != nil {
+		debugf("failed to flush '%s' after %s: %v", f.path, f.fs.opts.WriteBufferAge, err)
+	}
+}
+
+//Flush chunks the buffered writes and commits them to the database. Only
+//the chunks around the written ranges are re-chunked: chunking starts at the
+//chunk that holds the first dirty byte and stops as soon as a new boundary
+//after the last dirty byte coincides with an existing one, the chunks after
+//it are unchanged. Ranges that are not written and hold no data, like the
+//gap of a write beyond the end, become holes and so do chunks of zeros.
+func (f *File) Flush() error {
+	f.lock()
+	defer f.unlock()
+	return f.flush()
+}
+
+func (f *File) flush() (err error) {
+	if f.open.buf.empty() {
+		return nil
+	}
+
+	if err = f.fs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketNameFiles)
+		meta, txerr := LoadBoltFile(b, f.ino)
+		if txerr != nil {
+			return fmt.Errorf("failed to load '%s': %v", f.path, txerr)
+		}
+
+		size := meta.Size
+		if end := f.open.buf.end(); end > size {
+			size = end
+		}
+
+		refs := meta.Chunks
+		i := chunkIndex(refs, f.open.buf.start())
+		if i > 0 && i == len(refs) {
+			i-- //the last chunk was cut by the end of the file, not its content
+		}
+
+		var pos int64
+		if i < len(refs) {
+			pos = refs[i].Offset
+		} else if i > 0 {
+			pos = refs[i-1].Offset + refs[i-1].Size
+		}
+
+		updated := append([]ChunkRef{}, refs[:i]...)
+		replaced := refs[i:]
+
+		//stop when the boundaries are back in sync with the existing ones
+		synced := func() bool {
+			if pos < f.open.buf.end() {
+				return false
+			}
+
+			j := chunkIndex(refs, pos)
+			if j == len(refs) || refs[j].Offset != pos {
+				return false
+			}
+
+			replaced = refs[i:j]
+			for _, ref := range refs[j:] {
+				updated = appendRef(updated, ref)
+			}
+
+			return true
+		}
+
+	segments:
+		for _, seg := range f.segments(refs, pos, size) {
+			if seg.hole {
+				updated = appendRef(updated, ChunkRef{Offset: pos, Size: seg.end - pos})
+				pos = seg.end
+				if synced() {
+					break
+				}
+
+				continue
+			}
+
+			chunker, txerr := NewChunker(&contentReader{f: f, tx: tx, refs: refs, pos: pos, end: seg.end}, f.fs.opts.Chunking)
+			if txerr != nil {
+				return txerr
+			}
+
+			for {
+				c, txerr := chunker.Next()
+				if txerr == io.EOF {
+					break
+				} else if txerr != nil {
+					return txerr
+				}
+
+				ref := ChunkRef{Offset: pos, Size: int64(len(c))}
+				if !isZero(c) {
+					ref.K, txerr = f.fs.chunks.Put(tx, c)
+					if txerr != nil {
+						return fmt.Errorf("failed to put chunk of '%s': %v", f.path, txerr)
+					}
+				}
+
+				updated = appendRef(updated, ref)
+				pos += int64(len(c))
+				if synced() {
+					break segments
+				}
+			}
+		}
+
+		txerr = f.fs.chunks.Release(tx, chunkKeys(replaced))
+		if txerr != nil {
+			return fmt.Errorf("failed to release chunks of '%s': %v", f.path, txerr)
+		}
+
+		meta.Chunks = updated
+		meta.Size = size
+		meta.touch(f.open.buf.last)
+		f.update(meta)
+		return meta.Save(b, f.ino)
+	}); err != nil {
+		return err
+	}
+
+	f.open.buf.reset()
+	if f.open.timer != nil {
+		f.open.timer.Stop()
+		f.open.timer = nil
+	}
+
+	return nil
+}
+
+//SetTimes changes the file's timestamps, zero times are left unchanged.
+//Buffered writes are committed first such that they don't overwrite an
+//explicitly set modification time later on.
+func (f *File) SetTimes(created, accessed, modified time.Time) error {
+	f.lock()
+	defer f.unlock()
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	return f.updateMeta(func(tx *bolt.Tx, meta *BoltFile) error {
+		if !created.IsZero() {
+			meta.Created = created
+		}
+
+		if !accessed.IsZero() {
+			meta.Accessed = accessed
+		}
+
+		if !modified.IsZero() {
+			meta.Modified = modified
+		}
+
+		return nil
+	})
+}
+
+//Truncate changes the size of the file's content. Chunks after the new end
+//are released and the chunk that holds it is cut, when the file grows the
+//new content reads as zeros without storing any chunks for it.
+func (f *File) Truncate(size int64) error {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return ErrReadOnly
+	}
+
+	if size < 0 {
+		return fmt.Errorf("negative file size %d", size)
+	}
+
+	f.lock()
+	defer f.unlock()
+	if f.meta.ReadOnly() {
+		return ErrReadOnlyAttribute
+	}
+
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	return f.truncate(size)
 }
 
-//K is the fixd-sized hash key of a piece of file content
-type K [sha1.Size]byte
+//truncate changes the size of the committed content, the caller holds the
+//lock and has flushed or dropped the buffered writes
+func (f *File) truncate(size int64) error {
+	return f.updateMeta(func(tx *bolt.Tx, meta *BoltFile) error {
+		if size > meta.Size {
+			var end int64
+			if n := len(meta.Chunks); n > 0 {
+				end = meta.Chunks[n-1].Offset + meta.Chunks[n-1].Size
+			}
+
+			meta.Chunks = appendRef(meta.Chunks, ChunkRef{Offset: end, Size: size - end})
+		} else if size < meta.Size {
+			i := chunkIndex(meta.Chunks, size)
+			kept := append([]ChunkRef{}, meta.Chunks[:i]...)
+			released := meta.Chunks[i:]
+			if i < len(meta.Chunks) && meta.Chunks[i].Offset < size && meta.Chunks[i].IsHole() {
+				kept = append(kept, ChunkRef{Offset: meta.Chunks[i].Offset, Size: size - meta.Chunks[i].Offset})
+			} else if i < len(meta.Chunks) && meta.Chunks[i].Offset < size {
+				ref := meta.Chunks[i]
+				c, err := f.fs.chunks.Get(tx, ref.K)
+				if err != nil {
+					return fmt.Errorf("failed to get chunk '%s' of '%s': %v", ref.K, f.path, err)
+				}
+
+				k, err := f.fs.chunks.Put(tx, c[:size-ref.Offset])
+				if err != nil {
+					return fmt.Errorf("failed to put chunk of '%s': %v", f.path, err)
+				}
+
+				kept = append(kept, ChunkRef{K: k, Offset: ref.Offset, Size: size - ref.Offset})
+			}
+
+			if err := f.fs.chunks.Release(tx, chunkKeys(released)); err != nil {
+				return fmt.Errorf("failed to release chunks of '%s': %v", f.path, err)
+			}
+
+			meta.Chunks = kept
+		}
+
+		meta.Size = size
+		meta.touch(time.Now())
+		return nil
+	})
+}
+
+//updateMeta applies 'fn' to the latest version of the file's metadata and
+//stores the result in a single transaction, the caller holds the lock
+func (f *File) updateMeta(fn func(tx *bolt.Tx, meta *BoltFile) error) error {
+	return f.fs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketNameFiles)
+		meta, err := LoadBoltFile(b, f.ino)
+		if err != nil {
+			return fmt.Errorf("failed to load '%s': %v", f.path, err)
+		}
+
+		if err = fn(tx, meta); err != nil {
+			return err
+		}
+
+		if err = meta.Save(b, f.ino); err != nil {
+			return err
+		}
+
+		f.update(meta)
+		return nil
+	})
+}
+
+//SetSecurity replaces the ownership and access control of the file, nil
+//allows everyone full access
+func (f *File) SetSecurity(sec *Security) error {
+	if sec != nil {
+		if err := sec.Validate(); err != nil {
+			return err
+		}
+	}
+
+	f.lock()
+	defer f.unlock()
+	return f.updateMeta(func(tx *bolt.Tx, meta *BoltFile) error {
+		meta.Security = sec
+		return nil
+	})
+}
+
+//RemoveOnClose removes the file at joined path 'p' once all handles of
+//the file are closed, new handles can no longer be opened in the meantime.
+//If the file can't be removed an error is returned right away.
+func (f *File) RemoveOnClose(p ...[]byte) error {
+	if err := f.fs.CanRemove(p...); err != nil {
+		return err
+	}
+
+	if f.fs.handles.handles(f.ino) == 0 {
+		return f.fs.remove(f.ino, p...)
+	}
+
+	f.fs.handles.removeOnClose(f, p)
+	return nil
+}
+
+//Close commits any buffered writes, releases the file's locks and closes
+//the handle. Closing a handle again has no effect.
+func (f *File) Close() error {
+	f.fs.locks.UnlockAll(f)
+	err := f.Flush()
+	if p := f.fs.handles.remove(f); p != nil {
+		if err := f.fs.remove(f.ino, p...); err != nil {
+			return fmt.Errorf("failed to remove '%s' on close: %v", joinPath(p...), err)
+		}
+
+		f.lock()
+		f.open.buf.reset() //writes that failed to flush went with the file
+		f.unlock()
+	}
+
+	return err
+}
+
+//K is the hash key of a piece of file content, it is self-describing: the
+//first byte identifies the Hash algorithm and the rest is the digest
+type K []byte
 
 //Chunk holds a arbitrary-sized piece of file content
 type Chunk []byte
 
-//Open returns a file at joined path p, depending on provied
-//flags it may create necessary files (or not) on demand.
-func (fs *FileSystem) Open(p ...[]byte) (f *File, err error) {
+//ChunkRef places a chunk in a file's content, the offsets of a file's chunk
+//refs are cumulative such that the chunk covering a file offset can be
+//found with a binary search. A ref without a key is a hole: a range of
+//zeros that isn't stored.
+type ChunkRef struct {
+	K      K     `json:"k,omitempty"`
+	Offset int64 `json:"o"`
+	Size   int64 `json:"s"`
+}
+
+//IsHole returns whether the ref is a range of zeros without a chunk
+func (ref ChunkRef) IsHole() bool {
+	return len(ref.K) == 0
+}
+
+//appendRef appends 'ref' to 'refs', adjacent holes are merged into one
+func appendRef(refs []ChunkRef, ref ChunkRef) []ChunkRef {
+	if ref.Size == 0 {
+		return refs
+	}
+
+	if n := len(refs); n > 0 && ref.IsHole() && refs[n-1].IsHole() && refs[n-1].Offset+refs[n-1].Size == ref.Offset {
+		refs[n-1].Size += ref.Size
+		return refs
+	}
+
+	return append(refs, ref)
+}
+
+//isZero returns whether all bytes of 'p' are zero
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+//segment is a range of content that ends at 'end' and either holds data or
+//is a hole
+type segment struct {
+	end  int64
+	hole bool
+}
+
+//segments splits the content between 'pos' and 'end' into ranges of data
+//and holes, holes are neither buffered nor stored in chunks
+func (f *File) segments(refs []ChunkRef, pos, end int64) (segs []segment) {
+	for pos < end {
+		hole, next := true, end
+		if i := chunkIndex(refs, pos); i < len(refs) {
+			if refs[i].Offset > pos {
+				next = refs[i].Offset //content that was never written
+			} else {
+				hole, next = refs[i].IsHole(), refs[i].Offset+refs[i].Size
+			}
+		}
+
+		dirty, change := f.open.buf.dirty(pos)
+		if dirty {
+			hole, next = false, change
+		} else if change < next {
+			next = change
+		}
+
+		if next > end {
+			next = end
+		}
+
+		if n := len(segs); n > 0 && segs[n-1].hole == hole {
+			segs[n-1].end = next
+		} else {
+			segs = append(segs, segment{end: next, hole: hole})
+		}
+
+		pos = next
+	}
+
+	return segs
+}
+
+//chunkIndex returns the index of the chunk that holds byte 'offset', or
+//len(refs) if the offset lies beyond the last chunk
+func chunkIndex(refs []ChunkRef, offset int64) int {
+	return sort.Search(len(refs), func(i int) bool {
+		return refs[i].Offset+refs[i].Size > offset
+	})
+}
+
+//chunkKeys returns the keys of the referenced chunks, holes have none
+func chunkKeys(refs []ChunkRef) (ks []K) {
+	for _, ref := range refs {
+		if !ref.IsHole() {
+			ks = append(ks, ref.K)
+		}
+	}
+
+	return ks
+}
+
+//joinPath returns the joined path elements for use in messages
+func joinPath(p ...[]byte) []byte {
+	return append([]byte{'/'}, bytes.Join(p, []byte{'/'})...)
+}
+
+//childPath returns the path of entry 'name' in directory path 'dir'
+func childPath(dir, name []byte) []byte {
+	p := append([]byte(nil), dir...)
+	if !bytes.HasSuffix(p, []byte{'/'}) {
+		p = append(p, '/')
+	}
+
+	return append(p, name...)
+}
+
+//Open returns a file at joined path p, the flags work as for os.OpenFile:
+//the access mode is one of os.O_RDONLY, os.O_WRONLY or os.O_RDWR and may be
+//combined with os.O_CREATE, os.O_EXCL, os.O_TRUNC and os.O_APPEND. With
+//O_DIRECTORY or O_NOTDIRECTORY the file is required to be, or not to be, a
+//directory. An existing directory that is opened for writing is opened
+//read-only instead. A created file is stored in a single transaction, with
+//os.O_TRUNC the content is released once the file is opened, under the
+//lock that the other handles of the file share.
+func (fs *FileSystem) Open(flag int, p ...[]byte) (f *File, err error) {
+	return fs.OpenShared(flag, accessOf(flag), AccessAll, p...)
+}
+
+//OpenShared opens a file like Open but with an explicit 'access' and share
+//mode: the access that other handles of the file may have while it is
+//open. ErrSharingViolation is returned if either conflicts with a handle
+//that is already open, the file must be closed to release its handle.
+func (fs *FileSystem) OpenShared(flag int, access, share Access, p ...[]byte) (f *File, err error) {
+	f = &File{fs: fs, flag: flag, access: access, share: share, path: joinPath(p...)}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if flag&os.O_TRUNC != 0 && !writable {
+		return nil, ErrReadOnly
+	}
+
+	if flag&O_DIRECTORY != 0 && writable {
+		return nil, ErrIsDirectory
+	}
+
+	txfn := fs.db.View
+	if flag&os.O_CREATE != 0 {
+		txfn = fs.db.Update
+	}
+
+	registered, truncate := false, false
+	if err = txfn(func(tx *bolt.Tx) error {
+		parent, ino, txerr := resolve(tx, p...)
+		if txerr != nil {
+			return txerr
+		}
+
+		if ino == 0 {
+			if flag&os.O_CREATE == 0 {
+				return ErrNotExist
+			}
+
+			dir, txerr := LoadBoltFile(tx.Bucket(BucketNameFiles), parent)
+			if txerr != nil {
+				return fmt.Errorf("failed to load directory %d: %v", parent, txerr)
+			}
+
+			f.meta = NewBoltFile(flag&O_DIRECTORY != 0)
+			f.meta.file = f
+			f.meta.Security = dir.Security //new files inherit the access control of their directory
+			f.ino, txerr = createInode(tx, f.meta)
+			if txerr != nil {
+				return txerr
+			}
+
+			if txerr = link(tx, parent, p[len(p)-1], f.ino); txerr != nil {
+				return txerr
+			}
+
+			if txerr = fs.handles.add(f); txerr != nil {
+				return txerr
+			}
+
+			registered = true
+			return nil
+		}
+
+		b := tx.Bucket(BucketNameFiles)
+		meta, txerr := LoadBoltFile(b, ino)
+		if txerr != nil {
+			return fmt.Errorf("failed to load '%s': %v", f.path, txerr)
+		}
+
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return ErrExists
+		}
+
+		if flag&O_DIRECTORY != 0 && !meta.IsDirectory {
+			return ErrNotDirectory
+		}
+
+		if meta.IsDirectory && flag&(O_NOTDIRECTORY|os.O_TRUNC) != 0 {
+			return ErrIsDirectory
+		}
+
+		if meta.IsDirectory && writable {
+			//Windows opens directories for writing to change their times
+			//or attributes, the handle can't write content
+			f.flag &^= os.O_WRONLY | os.O_RDWR
+			writable = false
+		}
 
-	return nil, nil
+		if meta.ReadOnly() && writable {
+			return ErrReadOnlyAttribute
+		}
+
+		f.ino = ino
+		f.meta = meta
+		f.meta.file = f
+		if txerr = fs.handles.add(f); txerr != nil {
+			return txerr
+		}
+
+		registered = true
+		truncate = flag&os.O_TRUNC != 0
+		return nil
+	}); err != nil {
+		if registered {
+			fs.handles.remove(f)
+		}
+
+		return nil, err
+	}
+
+	if truncate {
+		f.lock()
+		f.open.buf.reset() //buffered writes of other handles are truncated too
+		err = f.truncate(0)
+		f.unlock()
+		if err != nil {
+			fs.handles.remove(f)
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+//Rename moves the file or directory at joined path 'src' to 'dst' in a
+//single transaction, directories are moved with everything in them. If
+//'dst' exists it is replaced when 'replace' is true, the content of a
+//replaced file is released. Otherwise ErrExists is returned. Like on NTFS a
+//file can't be replaced while it is open.
+func (fs *FileSystem) Rename(src, dst [][]byte, replace bool) error {
+	if len(src) == 0 || len(dst) == 0 {
+		return ErrInvalidName //the root cannot be moved or replaced
+	}
+
+	var replaced uint64
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		sparent, sino, err := resolve(tx, src...)
+		if err != nil {
+			return err
+		} else if sino == 0 {
+			return ErrNotExist
+		}
+
+		dparent, dino, err := resolve(tx, dst...)
+		if err != nil {
+			return err
+		}
+
+		if dino == sino {
+			return nil
+		}
+
+		if within(tx, sino, dst[:len(dst)-1]...) {
+			return ErrInvalidMove
+		}
+
+		if dino != 0 {
+			if !replace {
+				return ErrExists
+			}
+
+			target, err := LoadBoltFile(tx.Bucket(BucketNameFiles), dino)
+			if err != nil {
+				return fmt.Errorf("failed to load '%s': %v", joinPath(dst...), err)
+			}
+
+			if target.IsDirectory && !target.IsSymlink() {
+				return ErrIsDirectory
+			}
+
+			if target.ReadOnly() {
+				return ErrReadOnlyAttribute
+			}
+
+			if err = fs.handles.replaceable(dino); err != nil {
+				return err
+			}
+
+			if err = removeInode(tx, fs.chunks, dino); err != nil {
+				return err
+			}
+
+			replaced = dino
+		}
+
+		if err = unlink(tx, sparent, src[len(src)-1]); err != nil {
+			return err
+		}
+
+		return link(tx, dparent, dst[len(dst)-1], sino)
+	}); err != nil {
+		return err
+	}
+
+	return fs.refresh(replaced)
+}
+
+//maxHardLinks is the number of links a file can have, as on NTFS
+const maxHardLinks = 1024
+
+//Link adds a hard link at joined path 'dst' to the existing file at 'src',
+//both entries share the file's content and metadata until one is removed.
+//Directories cannot be hard linked. Dokan doesn't pass the creation of hard
+//links on, on Windows they only show up through NumberOfLinks.
+func (fs *FileSystem) Link(src, dst [][]byte) error {
+	if len(dst) == 0 {
+		return ErrExists
+	}
+
+	var sino uint64
+	if err := fs.db.Update(func(tx *bolt.Tx) (err error) {
+		_, sino, err = resolve(tx, src...)
+		if err != nil {
+			return err
+		} else if sino == 0 {
+			return ErrNotExist
+		}
+
+		dparent, dino, err := resolve(tx, dst...)
+		if err != nil {
+			return err
+		} else if dino != 0 {
+			return ErrExists
+		}
+
+		b := tx.Bucket(BucketNameFiles)
+		meta, err := LoadBoltFile(b, sino)
+		if err != nil {
+			return fmt.Errorf("failed to load '%s': %v", joinPath(src...), err)
+		}
+
+		if meta.IsDirectory {
+			return ErrIsDirectory
+		}
+
+		if meta.Links() >= maxHardLinks {
+			return ErrTooManyHardLinks
+		}
+
+		meta.Nlink = meta.Links() + 1
+		if err = meta.Save(b, sino); err != nil {
+			return err
+		}
+
+		return link(tx, dparent, dst[len(dst)-1], sino)
+	}); err != nil {
+		return err
+	}
+
+	return fs.refresh(sino)
+}
+
+//refresh updates the metadata of the open handles of inode 'ino' to its
+//latest record, if the inode was deleted the handles are left as is. It is
+//called once the change is committed, the lock of the file is taken first.
+func (fs *FileSystem) refresh(ino uint64) error {
+	var h *File
+	fs.handles.each(ino, func(o *File) {
+		if h == nil {
+			h = o
+		}
+	})
+
+	if h == nil {
+		return nil
+	}
+
+	h.lock()
+	defer h.unlock()
+	return fs.db.View(func(tx *bolt.Tx) error {
+		meta, err := LoadBoltFile(tx.Bucket(BucketNameFiles), ino)
+		if err == os.ErrNotExist {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to load inode %d: %v", ino, err)
+		}
+
+		h.update(meta)
+		return nil
+	})
+}
+
+//removable returns the inode of the file at joined path 'p' and its parent
+//or an error if the file cannot be removed
+func removable(tx *bolt.Tx, p ...[]byte) (parent, ino uint64, err error) {
+	if len(p) == 0 {
+		return 0, 0, ErrInvalidName //the root cannot be removed
+	}
+
+	parent, ino, err = resolve(tx, p...)
+	if err != nil {
+		return 0, 0, err
+	} else if ino == 0 {
+		return 0, 0, ErrNotExist
+	}
+
+	meta, err := LoadBoltFile(tx.Bucket(BucketNameFiles), ino)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to load '%s': %v", joinPath(p...), err)
+	}
+
+	if meta.ReadOnly() {
+		return 0, 0, ErrReadOnlyAttribute
+	}
+
+	if meta.IsDirectory {
+		prefix := inoKey(ino)
+		if k, _ := tx.Bucket(BucketNameDirents).Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+			return 0, 0, ErrNotEmpty
+		}
+	}
+
+	return parent, ino, nil
+}
+
+//CanRemove returns an error if the file or directory at joined path 'p'
+//cannot be removed, directories must be empty
+func (fs *FileSystem) CanRemove(p ...[]byte) error {
+	return fs.db.View(func(tx *bolt.Tx) error {
+		_, _, err := removable(tx, p...)
+		return err
+	})
+}
+
+//Remove deletes the file or empty directory at joined path 'p', the
+//references to its content are released in the same transaction
+func (fs *FileSystem) Remove(p ...[]byte) error {
+	return fs.remove(0, p...)
+}
+
+//remove deletes the file at joined path 'p', if 'expected' is not zero the
+//path must still refer to that inode or nothing is removed
+func (fs *FileSystem) remove(expected uint64, p ...[]byte) error {
+	var removed uint64
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		if expected != 0 {
+			if _, ino, err := resolve(tx, p...); err != nil || ino != expected {
+				return nil //the file was moved or replaced in the meantime
+			}
+		}
+
+		parent, ino, err := removable(tx, p...)
+		if err != nil {
+			return err
+		}
+
+		if err = unlink(tx, parent, p[len(p)-1]); err != nil {
+			return err
+		}
+
+		removed = ino
+		return removeInode(tx, fs.chunks, ino)
+	}); err != nil {
+		return err
+	}
+
+	return fs.refresh(removed)
+}
+
+//CollectGarbage removes chunks that are no longer referenced by any file or
+//extended attribute, it is safe to call while the file system is in use
+func (fs *FileSystem) CollectGarbage() (st GCStats, err error) {
+	return fs.chunks.Collect(fs.db, func(tx *bolt.Tx, ref func(k K)) error {
+		if err := xattrChunkKeys(tx, ref); err != nil {
+			return err
+		}
+
+		return tx.Bucket(BucketNameFiles).ForEach(func(ino, data []byte) error {
+			f := &BoltFile{}
+			if err := json.Unmarshal(data, f); err != nil {
+				return fmt.Errorf("failed to deserialize file %x: %v", ino, err)
+			}
+
+			for _, k := range chunkKeys(f.Chunks) {
+				ref(k)
+			}
+
+			return nil
+		})
+	})
+}
+
+//ChunkStats returns the de-duplication statistics of the volume's chunks
+func (fs *FileSystem) ChunkStats() (st ChunkStats, err error) {
+	err = fs.db.View(func(tx *bolt.Tx) error {
+		st = fs.chunks.Stats(tx)
+		return nil
+	})
+
+	return st, err
 }
 
 //List reads files at jained path elements 'p', if it doesn't
 //refer to a directory, an ErrNotDirectory is returned
 func (fs *FileSystem) List(p ...[]byte) (ls []*File, err error) {
-	return ls, nil
+	dir, err := fs.Open(os.O_RDONLY|O_DIRECTORY, p...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer dir.Close()
+	return dir.Readdir(nil)
 }
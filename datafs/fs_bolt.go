@@ -3,37 +3,80 @@ package datafs
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
+	"unsafe"
 
 	"github.com/boltdb/bolt"
 	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/dokan/winacl"
 	"golang.org/x/net/context"
 )
 
+const (
+	//FileAttributeSparseFile marks a file that has holes in its content
+	FileAttributeSparseFile = dokan.FileAttribute(0x00000200)
+
+	//FileAttributeNotContentIndexed excludes a file from content indexing
+	FileAttributeNotContentIndexed = dokan.FileAttribute(0x00002000)
+)
+
+//settableAttributes are the attributes that can be changed through
+//SetFileAttributes, others are derived from the file itself
+const settableAttributes = dokan.FileAttributeReadonly |
+	dokan.FileAttributeHidden |
+	dokan.FileAttributeSystem |
+	dokan.FileAttributeArchive |
+	FileAttributeNotContentIndexed
+
 var (
-	//BucketNameMetadata is the bucket name that holds filesystem metadata
+	//BucketNameMetadata is the bucket name that held filesystem metadata by
+	//path, volumes that still have it are migrated to inodes when opened
 	BucketNameMetadata = []byte("metadata")
 )
 
 //BoltFile is a file that is persisted in a memory mapped file instead of a block device
 type BoltFile struct {
-	IsDirectory bool `json:"d"`
-
+	IsDirectory bool                `json:"d"`
+	Size        int64               `json:"s,omitempty"`
+	Chunks      []ChunkRef          `json:"c,omitempty"`
+	Created     time.Time           `json:"ct"`
+	Accessed    time.Time           `json:"at"`
+	Modified    time.Time           `json:"mt"`
+	Attributes  dokan.FileAttribute `json:"a,omitempty"` //attributes other than the directory bit
+	Nlink       uint32              `json:"n,omitempty"`
+	Security    *Security           `json:"sec,omitempty"` //nil allows everyone full access
+	Target      []byte              `json:"lt,omitempty"`  //target of a symbolic link
+
+	file *File //the opened file this record belongs to
 	EmptyFile
 }
 
 //NewBoltFile sets up memory for a boltfile
 func NewBoltFile(isdir bool) *BoltFile {
-	return &BoltFile{
+	now := time.Now()
+	f := &BoltFile{
 		IsDirectory: isdir,
+		Created:     now,
+		Accessed:    now,
+		Modified:    now,
+		Nlink:       1,
 	}
+
+	if !isdir {
+		f.Attributes = dokan.FileAttributeArchive
+	}
+
+	return f
 }
 
-//LoadBoltFile will attempt to read and deserialize a file from the database
-func LoadBoltFile(b *bolt.Bucket, path string) (f *BoltFile, err error) {
-	data := b.Get([]byte(path))
+//LoadBoltFile will attempt to read and deserialize the file with inode
+//number 'ino' from the database
+func LoadBoltFile(b *bolt.Bucket, ino uint64) (f *BoltFile, err error) {
+	data := b.Get(inoKey(ino))
 	if data == nil {
 		return nil, os.ErrNotExist
 	}
@@ -41,26 +84,256 @@ func LoadBoltFile(b *bolt.Bucket, path string) (f *BoltFile, err error) {
 	f = &BoltFile{}
 	err = json.Unmarshal(data, f)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize file '%s': %v", path, err)
+		return nil, fmt.Errorf("failed to deserialize file %d: %v", ino, err)
 	}
 
 	return f, nil
 }
 
-//Save the boltfile state to the database
-func (f *BoltFile) Save(b *bolt.Bucket, path string) error {
+//Save the boltfile state to the database as inode 'ino'
+func (f *BoltFile) Save(b *bolt.Bucket, ino uint64) error {
 	data, err := json.Marshal(f)
 	if err != nil {
-		return fmt.Errorf("failed to serialize file '%s': %v", path, err)
+		return fmt.Errorf("failed to serialize file %d: %v", ino, err)
 	}
 
-	return b.Put([]byte(path), data)
+	return b.Put(inoKey(ino), data)
+}
+
+//set copies the persisted fields of 'meta' into the record, the opened file
+//it belongs to is left as is since it is read without holding the lock
+func (f *BoltFile) set(meta *BoltFile) {
+	f.IsDirectory = meta.IsDirectory
+	f.Size = meta.Size
+	f.Chunks = meta.Chunks
+	f.Created = meta.Created
+	f.Accessed = meta.Accessed
+	f.Modified = meta.Modified
+	f.Attributes = meta.Attributes
+	f.Nlink = meta.Nlink
+	f.Security = meta.Security
+	f.Target = meta.Target
 }
 
-//IsDir returns if the metadata information describes a file
+//IsDir returns if the metadata information describes a directory
 func (f *BoltFile) IsDir() bool {
-	//@TODO implement
-	return false
+	return f.IsDirectory
+}
+
+//touch records that the file's content was written at 't', like NTFS this
+//marks the file for archiving. Reads don't update the access time, which
+//would turn every read into a write transaction.
+func (f *BoltFile) touch(t time.Time) {
+	f.Modified = t
+	f.Accessed = t
+	if !f.IsDirectory {
+		f.Attributes |= dokan.FileAttributeArchive
+	}
+}
+
+//FileAttributes returns the attributes as reported to Windows
+func (f *BoltFile) FileAttributes() dokan.FileAttribute {
+	attrs := f.Attributes
+	if f.IsDirectory {
+		attrs |= dokan.FileAttributeDirectory
+	}
+
+	if f.Sparse() {
+		attrs |= FileAttributeSparseFile
+	}
+
+	if f.IsSymlink() {
+		attrs |= dokan.FileAttributeReparsePoint
+	}
+
+	if attrs == 0 {
+		return dokan.FileAttributeNormal
+	}
+
+	return attrs
+}
+
+//Sparse returns whether part of the file's content is a hole
+func (f *BoltFile) Sparse() bool {
+	var end int64
+	for _, ref := range f.Chunks {
+		if ref.IsHole() || ref.Offset > end {
+			return true
+		}
+
+		end = ref.Offset + ref.Size
+	}
+
+	return end < f.Size
+}
+
+//IsSymlink returns whether the file is a symbolic link
+func (f *BoltFile) IsSymlink() bool {
+	return len(f.Target) > 0
+}
+
+//ReadOnly returns whether the file has the read-only attribute
+func (f *BoltFile) ReadOnly() bool {
+	return f.Attributes&dokan.FileAttributeReadonly != 0
+}
+
+//Links returns the number of directory entries that refer to the file
+func (f *BoltFile) Links() uint32 {
+	if f.Nlink == 0 {
+		return 1 //records from before link counting
+	}
+
+	return f.Nlink
+}
+
+//boltFile returns the dokan representation of an opened file
+func boltFile(f *File) *BoltFile {
+	return f.meta
+}
+
+// ReadFile implements read for dokan.
+func (f *BoltFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	n, err = f.file.Read(offset, bs)
+	if err == io.EOF {
+		return n, nil //dokan signals the end of a file by a short read
+	}
+
+	return n, dokanError(err)
+}
+
+// WriteFile implements write for dokan.
+func (f *BoltFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
+	n, err := f.file.Write(offset, bs)
+	return n, dokanError(err)
+}
+
+// FlushFileBuffers corresponds to fsync.
+func (f *BoltFile) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) error {
+	return f.file.Flush()
+}
+
+// Cleanup is called after the last handle from userspace is closed.
+// Cleanup must perform actual deletions marked from CanDelete*
+// by checking FileInfo.IsDeleteOnClose if the filesystem supports
+// deletions.
+func (f *BoltFile) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
+	if fi.IsDeleteOnClose() {
+		if err := f.file.RemoveOnClose(splitPath(fi.Path())...); err != nil {
+			debugf("failed to delete '%s' on cleanup: %v", fi.Path(), err)
+		}
+	}
+
+	//like NTFS the share mode is released on cleanup, not when closing
+	if err := f.file.Close(); err != nil {
+		debugf("failed to close '%s' on cleanup: %v", f.file.path, err)
+	}
+}
+
+// CanDeleteFile and CanDeleteDirectory should check whether the file/directory
+// can be deleted. The actual deletion should be done by checking
+// FileInfo.IsDeleteOnClose in Cleanup.
+func (f *BoltFile) CanDeleteFile(ctx context.Context, fi *dokan.FileInfo) error {
+	return dokanError(f.file.fs.CanRemove(splitPath(fi.Path())...))
+}
+
+// CanDeleteDirectory should check whether the file/directory
+// can be deleted. The actual deletion should be done by checking
+// FileInfo.IsDeleteOnClose in Cleanup.
+func (f *BoltFile) CanDeleteDirectory(ctx context.Context, fi *dokan.FileInfo) error {
+	return dokanError(f.file.fs.CanRemove(splitPath(fi.Path())...))
+}
+
+// CloseFile is called when closing a handle to the file.
+func (f *BoltFile) CloseFile(ctx context.Context, fi *dokan.FileInfo) {
+	if err := f.file.Close(); err != nil {
+		debugf("failed to close '%s': %v", f.file.path, err)
+	}
+}
+
+// SetEndOfFile truncates the file. May be used to extend a file with zeros.
+func (f *BoltFile) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	return dokanError(f.file.Truncate(length))
+}
+
+// SetAllocationSize see FILE_ALLOCATION_INFORMATION on MSDN.
+// For simple semantics if length > filesize then ignore else truncate(length).
+func (f *BoltFile) SetAllocationSize(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	if length >= f.file.Size() {
+		return nil //space is never preallocated
+	}
+
+	return dokanError(f.file.Truncate(length))
+}
+
+// LockFile at a specific offset and data length. This is only used if \ref DOKAN_OPTION_FILELOCK_USER_MODE is enabled.
+func (f *BoltFile) LockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) error {
+	return dokanError(f.file.fs.locks.Lock(f.file, offset, length, true))
+}
+
+//UnlockFile at a specific offset and data lengthh. This is only used if \ref DOKAN_OPTION_FILELOCK_USER_MODE is enabled.
+func (f *BoltFile) UnlockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) error {
+	return dokanError(f.file.fs.locks.Unlock(f.file, offset, length))
+}
+
+// SetFileTime sets file times, zero times must be left unchanged.
+func (f *BoltFile) SetFileTime(ctx context.Context, fi *dokan.FileInfo, creation time.Time, lastAccess time.Time, lastWrite time.Time) error {
+	return f.file.SetTimes(creation, lastAccess, lastWrite)
+}
+
+// SetFileAttributes is for setting file attributes, zero leaves them
+// unchanged and FileAttributeNormal clears them.
+func (f *BoltFile) SetFileAttributes(ctx context.Context, fi *dokan.FileInfo, fileAttributes dokan.FileAttribute) error {
+	if fileAttributes == 0 {
+		return nil
+	}
+
+	f.file.lock()
+	defer f.file.unlock()
+	return f.file.updateMeta(func(tx *bolt.Tx, meta *BoltFile) error {
+		meta.Attributes = fileAttributes & settableAttributes
+		return nil
+	})
+}
+
+// GetFileSecurity gets specified information about the security of a file or directory.
+func (f *BoltFile) GetFileSecurity(ctx context.Context, fi *dokan.FileInfo, si winacl.SecurityInformation, sd *winacl.SecurityDescriptor) error {
+	f.file.lock()
+	sec := f.Security
+	f.file.unlock()
+	if sec == nil {
+		return nil
+	}
+
+	if si&winacl.OwnerSecurityInformation != 0 && sec.Owner != nil {
+		sd.SetOwner(winSID(sec.Owner))
+	}
+
+	if si&winacl.GroupSecurityInformation != 0 && sec.Group != nil {
+		sd.SetGroup(winSID(sec.Group))
+	}
+
+	if si&winacl.DACLSecurityInformation != 0 && len(sec.DACL) > 0 {
+		acl := &winacl.ACL{}
+		for _, ace := range sec.DACL {
+			acl.AddAllowAccess(ace.Mask, winSID(ace.SID))
+		}
+
+		sd.SetDacl(acl)
+	}
+
+	return nil
+}
+
+// SetFileSecurity sets the security of a file or directory object. The
+// winacl descriptor can only be written, not read, so changes are refused;
+// use File.SetSecurity instead.
+func (f *BoltFile) SetFileSecurity(ctx context.Context, fi *dokan.FileInfo, si winacl.SecurityInformation, sd *winacl.SecurityDescriptor) error {
+	return dokan.ErrNotSupported
+}
+
+//winSID returns the winacl view of a validated SID
+func winSID(sid SID) *winacl.SID {
+	return (*winacl.SID)(unsafe.Pointer(&sid[0]))
 }
 
 // FindFiles is the readdir. The function is a callback that should be called
@@ -70,66 +343,138 @@ func (f *BoltFile) IsDir() bool {
 // it may be a pattern like `*.png` to match. All implementations must be prepared
 // to handle empty strings as patterns.
 func (f *BoltFile) FindFiles(ctx context.Context, fi *dokan.FileInfo, pattern string, fillStatCallback func(*dokan.NamedStat) error) error {
+	files, err := f.file.Readdir([]byte(pattern))
+	if err != nil {
+		return dokanError(err)
+	}
+
+	for _, file := range files {
+		if err = fillStatCallback(&dokan.NamedStat{
+			Name: string(file.Name()),
+			Stat: *boltFile(file).stat(),
+		}); err != nil {
+			return err
+		}
+	}
 
-	// &dokan.NamedStat{}
 	return nil
 }
 
 // GetFileInformation - corresponds to stat.
 func (f *BoltFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (st *dokan.Stat, err error) {
-	st = &dokan.Stat{
-		Creation:           time.Now(),                // Timestamps for the file
-		LastAccess:         time.Now(),                // Timestamps for the file
-		LastWrite:          time.Now(),                // Timestamps for the file
-		FileSize:           5,                         // FileSize is the size of the file in bytes
-		FileIndex:          1000,                      // FileIndex is a 64 bit (nearly) unique ID of the file
-		FileAttributes:     dokan.FileAttributeNormal, // FileAttributes bitmask holds the file attributes
-		VolumeSerialNumber: 0,                         // VolumeSerialNumber is the serial number of the volume (0 is fine)
-		NumberOfLinks:      1,                         // NumberOfLinks can be omitted, if zero set to 1.
-		ReparsePointTag:    0,                         // ReparsePointTag is for WIN32_FIND_DATA dwReserved0 for reparse point tags, typically it can be omitted.
+	return f.stat(), nil
+}
+
+//stat returns the dokan representation of the file's metadata
+func (f *BoltFile) stat() *dokan.Stat {
+	f.file.lock()
+	defer f.file.unlock()
+	return &dokan.Stat{
+		Creation:           f.Created,          // Timestamps for the file
+		LastAccess:         f.Accessed,         // Timestamps for the file
+		LastWrite:          f.file.modTime(),   // Timestamps for the file
+		FileSize:           f.file.size(),      // FileSize is the size of the file in bytes
+		FileIndex:          f.file.Ino(),       // FileIndex is the inode number, it is never reused
+		FileAttributes:     f.FileAttributes(), // FileAttributes bitmask holds the file attributes
+		VolumeSerialNumber: 0,                  // VolumeSerialNumber is the serial number of the volume (0 is fine)
+		NumberOfLinks:      f.Links(),          // NumberOfLinks can be omitted, if zero set to 1.
+		ReparsePointTag:    f.reparseTag(),     // ReparsePointTag is for WIN32_FIND_DATA dwReserved0 for reparse point tags, typically it can be omitted.
 	}
+}
 
-	if f.IsDir() {
-		st.FileAttributes = dokan.FileAttributeDirectory
+//reparseTag returns the tag of the reparse point the file is, if any
+func (f *BoltFile) reparseTag() uint32 {
+	if f.IsSymlink() {
+		return dokan.IOReparseTagSymlink
 	}
 
-	return st, nil
+	return 0
 }
 
 //BoltFS creates a file system on top of the bolt memory-map kv database
 type BoltFS struct {
 	logs *log.Logger
-	db   *bolt.DB
 
+	*FileSystem
 	*EmptyFS //@TODO progressively make remove this
 }
 
-//NewBoltFS will setup the database for the fs
-func NewBoltFS(logs *log.Logger, db *bolt.DB) (fs *BoltFS, err error) {
+//NewBoltFS will setup the database for the fs, if 'opts' is nil the
+//DefaultOptions are used
+func NewBoltFS(logs *log.Logger, db *bolt.DB, opts *Options) (fs *BoltFS, err error) {
 	fs = &BoltFS{
 		logs:    logs,
-		db:      db,
 		EmptyFS: &EmptyFS{},
 	}
 
-	if err = fs.db.Update(func(tx *bolt.Tx) error {
-		b, txerr := tx.CreateBucketIfNotExists(BucketNameMetadata)
-		if txerr != nil {
-			return txerr
-		}
+	fs.FileSystem, err = NewFileSystem(db, opts)
+	if err != nil {
+		return nil, err
+	}
 
-		root := NewBoltFile(true)
-		txerr = root.Save(b, `\`)
-		if txerr != nil {
-			return fmt.Errorf("failed to create root: %v", txerr)
+	return fs, nil
+}
+
+//splitPath splits a dokan path into the path elements of the file system
+func splitPath(p string) (elems [][]byte) {
+	for _, e := range strings.Split(p, `\`) {
+		if e == "" {
+			continue
 		}
 
-		return txerr
-	}); err != nil {
-		return nil, err
+		elems = append(elems, []byte(e))
 	}
 
-	return fs, nil
+	return elems
+}
+
+//NTSTATUS codes that dokan doesn't define
+const (
+	errSharingViolation   = dokan.NtStatus(0xC0000043)
+	errFileLockConflict   = dokan.NtStatus(0xC0000054)
+	errLockNotGranted     = dokan.NtStatus(0xC0000055)
+	errDeletePending      = dokan.NtStatus(0xC0000056)
+	errRangeNotLocked     = dokan.NtStatus(0xC000007E)
+	errTooManyLinks       = dokan.NtStatus(0xC0000265)
+	errNotAReparsePoint   = dokan.NtStatus(0xC0000275)
+	errReparseNotResolved = dokan.NtStatus(0xC0000280)
+)
+
+//dokanError translates file system errors into the NTSTATUS codes
+//that dokan expects
+func dokanError(err error) error {
+	switch err {
+	case ErrExists:
+		return dokan.ErrObjectNameCollision
+	case ErrNotExist, ErrNoXattr:
+		return dokan.ErrObjectNameNotFound
+	case ErrNotDirectory, ErrPathNotFound:
+		return dokan.ErrObjectPathNotFound
+	case ErrIsDirectory:
+		return dokan.ErrFileIsADirectory
+	case ErrNotEmpty:
+		return dokan.ErrDirectoryNotEmpty
+	case ErrTooManyHardLinks:
+		return errTooManyLinks
+	case ErrLockConflict:
+		return errLockNotGranted
+	case ErrRangeLocked:
+		return errFileLockConflict
+	case ErrNotLocked:
+		return errRangeNotLocked
+	case ErrSharingViolation:
+		return errSharingViolation
+	case ErrDeletePending:
+		return errDeletePending
+	case ErrNotSymlink:
+		return errNotAReparsePoint
+	case ErrTooManyLinks:
+		return errReparseNotResolved
+	case ErrReadOnly, ErrReadOnlyAttribute, ErrInvalidName, ErrInvalidMove, ErrAccessDenied:
+		return dokan.ErrAccessDenied
+	default:
+		return err
+	}
 }
 
 // GetVolumeInformation returns information about the volume.
@@ -142,80 +487,133 @@ func (fs *BoltFS) GetVolumeInformation(ctx context.Context) (dokan.VolumeInforma
 			dokan.FileCaseSensitiveSearch | //The file system supports case-sensitive file names.
 			dokan.FileUnicodeOnDisk | //The file system supports Unicode in file names.
 			dokan.FileSupportsReparsePoints | //The file system supports reparse points.
+			dokan.FileSupportsSparseFiles | //The file system supports sparse files.
+			dokan.FileNamedStreams | //The file system supports named streams, they are stored as extended attributes.
 			dokan.FileSupportsRemoteStorage, //The file system supports remote storage.
 		FileSystemName: "Nerdalize Compute Engine",
 		VolumeName:     "My-Organization",
 	}, nil
 }
 
-// CreateFile is called to open and create files.
+//Rights in CreateData.DesiredAccess that are subject to share modes
+const (
+	//accessRead allows reading a file's content: FILE_READ_DATA,
+	//FILE_EXECUTE, GENERIC_ALL, GENERIC_EXECUTE and GENERIC_READ
+	accessRead = 0x00000001 | 0x00000020 | 0x10000000 | 0x20000000 | 0x80000000
+
+	//accessWrite allows modifying a file's content: FILE_WRITE_DATA,
+	//FILE_APPEND_DATA, GENERIC_ALL and GENERIC_WRITE
+	accessWrite = 0x00000002 | 0x00000004 | 0x10000000 | 0x40000000
+
+	//accessDelete allows removing a file: DELETE and GENERIC_ALL
+	accessDelete = 0x00010000 | 0x10000000
+)
+
+//shareAccess translates the desired access and the FILE_SHARE_READ,
+//FILE_SHARE_WRITE and FILE_SHARE_DELETE bits of a create request
+func shareAccess(cd *dokan.CreateData) (access, share Access) {
+	if cd.DesiredAccess&accessRead != 0 {
+		access |= AccessRead
+	}
+
+	if cd.DesiredAccess&accessWrite != 0 {
+		access |= AccessWrite
+	}
+
+	if cd.DesiredAccess&accessDelete != 0 {
+		access |= AccessDelete
+	}
+
+	return access, Access(cd.ShareAccess) & AccessAll
+}
+
+// CreateFile is called to open and create files. Dokan cannot hand a
+// reparse buffer back to Windows, so symbolic links in the path are followed
+// here unless FILE_OPEN_REPARSE_POINT is given to open the link itself.
 func (fs *BoltFS) CreateFile(ctx context.Context, fi *dokan.FileInfo, cd *dokan.CreateData) (f dokan.File, isDir bool, err error) {
 	fs.logs.Printf("BoltFS.CreateFile(ctx, fi{Path: '%s'} cd{CreateDisposition: '%d'})", fi.Path(), cd.CreateDisposition)
 
+	//only the rights to write content open the file for writing, rights like
+	//FILE_WRITE_ATTRIBUTES don't and a directory falls back to read-only
+	flag := os.O_RDONLY
+	if cd.CreateOptions&dokan.FileDirectoryFile != 0 {
+		flag |= O_DIRECTORY
+	} else if cd.DesiredAccess&accessWrite != 0 {
+		flag |= os.O_RDWR
+	}
+
+	if cd.CreateOptions&dokan.FileNonDirectoryFile != 0 {
+		flag |= O_NOTDIRECTORY
+	}
+
 	//Specifies what to do, depending on whether the file already exists, as one of the following values.
 	switch cd.CreateDisposition {
 	case dokan.FileSupersede:
 		// FileSupersede   = CreateDisposition(0) If the file already exists, replace
 		//it with the given file. If it does not, create the given file.
+		flag |= os.O_RDWR | os.O_CREATE | os.O_TRUNC
 
 	case dokan.FileOpen:
 		// FileOpen        = CreateDisposition(1) If the file already exists, open it
 		//instead of creating a new file. If it does not, fail the request and do
 		//not create a new file
-		var f *BoltFile
-		if err = fs.db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(BucketNameMetadata)
-			f, err = LoadBoltFile(b, fi.Path())
-			if err != nil {
-				if os.IsNotExist(err) {
-					return dokan.ErrObjectPathNotFound //file doesnt exist
-				}
-
-				return err //other error
-			}
-
-			//file exists and deserialized
-			return nil
-		}); err != nil {
-			return nil, false, err
-		}
 
-		return f, f.IsDir(), nil
 	case dokan.FileCreate:
 		// FileCreate      = CreateDisposition(2) If the file already exists, fail
 		//the request and do not create or open the given file. If it does not,
 		//create the given file.
+		flag |= os.O_CREATE | os.O_EXCL
 
 	case dokan.FileOpenIf:
 		// FileOpenIf      = CreateDisposition(3) If the file already exists, open
 		//it. If it does not, create the given file.
+		flag |= os.O_CREATE
 
 	case dokan.FileOverwrite:
 		// FileOverwrite   = CreateDisposition(4) If the file already exists, open
 		//it and overwrite it. If it does not, fail the request.
+		flag |= os.O_RDWR | os.O_TRUNC
 
 	case dokan.FileOverwriteIf:
 		// FileOverwriteIf = CreateDisposition(5) If the file already exists, open
 		//it and overwrite it. If it does not, create the given file.
-		var f *BoltFile
-		if err = fs.db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket(BucketNameMetadata)
-			f = NewBoltFile(false)
-			//@TODO set populate file attributes
-
-			//always overwrite file in db
-			err = f.Save(b, fi.Path())
-			if err != nil {
-				return err
-			}
-
-			return nil
-		}); err != nil {
-			return nil, false, err
+		flag |= os.O_RDWR | os.O_CREATE | os.O_TRUNC
+
+	default:
+		return nil, false, dokan.ErrNotSupported
+	}
+
+	p, stream, err := splitStream(splitPath(fi.Path()))
+	if err != nil {
+		return nil, false, dokanError(err)
+	}
+
+	if cd.CreateOptions&dokan.FileOpenReparsePoint == 0 {
+		if p, err = fs.FollowSymlinks(p...); err != nil {
+			return nil, false, dokanError(err)
 		}
+	}
 
-		return f, f.IsDir(), nil
+	access, share := shareAccess(cd)
+	if stream != nil {
+		sf, err := fs.openStream(flag, access, share, stream, p...)
+		if err != nil {
+			return nil, false, dokanError(err)
+		}
+
+		return sf, false, nil
 	}
 
-	return nil, false, dokan.ErrNotSupported
+	file, err := fs.OpenShared(flag, access, share, p...)
+	if err != nil {
+		return nil, false, dokanError(err)
+	}
+
+	return boltFile(file), file.IsDir(), nil
+}
+
+// MoveFile corresponds to rename.
+func (fs *BoltFS) MoveFile(ctx context.Context, source *dokan.FileInfo, targetPath string, replaceExisting bool) error {
+	fs.logs.Printf("BoltFS.MoveFile(ctx, source{Path: '%s'}, '%s', %v)", source.Path(), targetPath, replaceExisting)
+	return dokanError(fs.Rename(splitPath(source.Path()), splitPath(targetPath), replaceExisting))
 }
@@ -0,0 +1,458 @@
+package datafs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/keybase/kbfs/dokan"
+	"golang.org/x/net/context"
+)
+
+//splitStream splits the stream off the last element of path 'p', such that
+//'a.txt:Zone.Identifier:$DATA' names stream 'Zone.Identifier' of 'a.txt'.
+//The stream is nil for the unnamed stream, which is the file's content.
+func splitStream(p [][]byte) (file [][]byte, stream []byte, err error) {
+	if len(p) == 0 || bytes.IndexByte(p[len(p)-1], ':') < 0 {
+		return p, nil, nil
+	}
+
+	parts := bytes.SplitN(p[len(p)-1], []byte(":"), 3)
+	if len(parts) == 3 && !bytes.Equal(parts[2], []byte("$DATA")) {
+		return nil, nil, ErrInvalidName //only data streams are supported
+	}
+
+	file = append(append([][]byte{}, p[:len(p)-1]...), parts[0])
+	if len(parts[1]) == 0 {
+		return file, nil, nil
+	}
+
+	return file, parts[1], nil
+}
+
+//openStream is the state of a stream that has open handles, the handles
+//share its value such that they see each other's writes. The value is held
+//in memory until the last handle is closed, also when it is larger than
+//xattrInlineSize and stored in chunks.
+type openStream struct {
+	id      uint64 //identifies the stream to the lock manager
+	mu      sync.Mutex
+	data    []byte
+	dirty   bool
+	removal bool //remove the attribute when the last handle is closed
+	handles []*Stream
+}
+
+//streamTable keeps track of the opened streams, like on NTFS every stream
+//has its own share modes and byte-range locks
+type streamTable struct {
+	mu      sync.Mutex
+	opened  uint64
+	streams map[string]*openStream
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{streams: map[string]*openStream{}}
+}
+
+//Stream is an opened alternate data stream, it reads and writes the
+//extended attribute of the same name
+type Stream struct {
+	fs     *FileSystem
+	ino    uint64
+	path   [][]byte
+	name   []byte
+	flag   int
+	access Access
+	share  Access
+	owner  *File //holds the byte-range locks of the handle
+	s      *openStream
+}
+
+//OpenStream opens alternate data stream 'name' of the file at joined path
+//'p' with the os.O_* flags of Open and the share mode of OpenShared. Like
+//on NTFS a missing file is created along with the stream.
+func (fs *FileSystem) OpenStream(flag int, access, share Access, name []byte, p ...[]byte) (*Stream, error) {
+	if err := checkXattrName(name); err != nil {
+		return nil, err
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if flag&os.O_TRUNC != 0 && !writable {
+		return nil, ErrReadOnly
+	}
+
+	if flag&os.O_CREATE != 0 {
+		f, err := fs.Open(os.O_RDONLY|os.O_CREATE, p...)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = f.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	var ino uint64
+	var meta *BoltFile
+	if err := fs.db.View(func(tx *bolt.Tx) (err error) {
+		if ino, err = xattrInode(tx, p...); err != nil {
+			return err
+		}
+
+		meta, err = LoadBoltFile(tx.Bucket(BucketNameFiles), ino)
+		if err != nil {
+			return fmt.Errorf("failed to load '%s': %v", joinPath(p...), err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if meta.ReadOnly() && writable {
+		return nil, ErrReadOnlyAttribute
+	}
+
+	st := fs.streams
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := string(xattrKey(ino, name))
+	s := st.streams[key]
+	if s == nil {
+		s = &openStream{}
+		value, err := fs.Xattr(name, p...)
+		switch {
+		case err == ErrNoXattr && flag&os.O_CREATE != 0:
+			if meta.ReadOnly() {
+				return nil, ErrReadOnlyAttribute
+			}
+
+			if err = fs.SetXattr(name, nil, p...); err != nil {
+				return nil, err
+			}
+		case err != nil:
+			return nil, err
+		case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return nil, ErrExists
+		default:
+			s.data = value
+		}
+
+		//stream ids count down from the largest inode number, they won't
+		//meet the inode numbers that count up
+		s.id = math.MaxUint64 - st.opened
+		st.opened++
+	} else if s.removal {
+		return nil, ErrDeletePending
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, ErrExists
+	}
+
+	for _, h := range s.handles {
+		if access != 0 && h.access != 0 && conflicts(access, share, h.access, h.share) {
+			return nil, ErrSharingViolation
+		}
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		s.mu.Lock()
+		s.data, s.dirty = nil, true
+		s.mu.Unlock()
+	}
+
+	sf := &Stream{fs: fs, ino: ino, path: p, name: name, flag: flag, access: access, share: share, s: s}
+	sf.owner = &File{fs: fs, ino: s.id, path: joinPath(append(p[:len(p):len(p)], name)...)}
+	s.handles = append(s.handles, sf)
+	st.streams[key] = s
+	return sf, nil
+}
+
+//Read copies the stream's value at 'offset' into 'buf', like File.Read it
+//returns io.EOF when the end is reached before 'buf' is filled
+func (sf *Stream) Read(offset int64, buf []byte) (int, error) {
+	if err := sf.fs.locks.check(sf.owner, offset, int64(len(buf)), false); err != nil {
+		return 0, err
+	}
+
+	sf.s.mu.Lock()
+	defer sf.s.mu.Unlock()
+	if offset >= int64(len(sf.s.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(buf, sf.s.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+//Write puts 'buf' into the stream's value at 'offset', it is stored when
+//the stream is flushed
+func (sf *Stream) Write(offset int64, buf []byte) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative write offset %d", offset)
+	}
+
+	if err := sf.writable(); err != nil {
+		return 0, err
+	}
+
+	if err := sf.fs.locks.check(sf.owner, offset, int64(len(buf)), true); err != nil {
+		return 0, err
+	}
+
+	sf.s.mu.Lock()
+	defer sf.s.mu.Unlock()
+	if end := offset + int64(len(buf)); end > int64(len(sf.s.data)) {
+		sf.s.data = append(sf.s.data, make([]byte, end-int64(len(sf.s.data)))...)
+	}
+
+	sf.s.dirty = true
+	return copy(sf.s.data[offset:], buf), nil
+}
+
+//Truncate changes the size of the stream's value
+func (sf *Stream) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative stream size %d", size)
+	}
+
+	if err := sf.writable(); err != nil {
+		return err
+	}
+
+	sf.s.mu.Lock()
+	defer sf.s.mu.Unlock()
+	if size < int64(len(sf.s.data)) {
+		sf.s.data = sf.s.data[:size]
+	} else {
+		sf.s.data = append(sf.s.data, make([]byte, size-int64(len(sf.s.data)))...)
+	}
+
+	sf.s.dirty = true
+	return nil
+}
+
+//writable returns an error if the stream cannot be modified through the
+//handle, like File.Write it must be opened for writing and its file must
+//not have the read-only attribute
+func (sf *Stream) writable() error {
+	if sf.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return ErrReadOnly
+	}
+
+	meta, err := sf.Stat()
+	if err != nil {
+		return err
+	}
+
+	if meta.ReadOnly() {
+		return ErrReadOnlyAttribute
+	}
+
+	return nil
+}
+
+//Size returns the size of the stream's value, including unflushed writes
+func (sf *Stream) Size() int64 {
+	sf.s.mu.Lock()
+	defer sf.s.mu.Unlock()
+	return int64(len(sf.s.data))
+}
+
+//Lock locks 'n' bytes at offset 'off' of the stream, see LockManager.Lock
+func (sf *Stream) Lock(off, n int64, exclusive bool) error {
+	return sf.fs.locks.Lock(sf.owner, off, n, exclusive)
+}
+
+//Unlock removes a lock of the stream handle, see LockManager.Unlock
+func (sf *Stream) Unlock(off, n int64) error {
+	return sf.fs.locks.Unlock(sf.owner, off, n)
+}
+
+//Flush stores the stream's value as its extended attribute
+func (sf *Stream) Flush() error {
+	sf.s.mu.Lock()
+	defer sf.s.mu.Unlock()
+	if !sf.s.dirty || sf.s.removal {
+		return nil
+	}
+
+	if err := sf.fs.SetXattr(sf.name, sf.s.data, sf.path...); err != nil {
+		return err
+	}
+
+	sf.s.dirty = false
+	return nil
+}
+
+//CanRemove returns an error if the stream cannot be removed, like a file it
+//can't be while its file has the read-only attribute
+func (sf *Stream) CanRemove() error {
+	meta, err := sf.Stat()
+	if err != nil {
+		return err
+	}
+
+	if meta.ReadOnly() {
+		return ErrReadOnlyAttribute
+	}
+
+	return nil
+}
+
+//RemoveOnClose removes the stream once all of its handles are closed, new
+//handles can no longer be opened in the meantime
+func (sf *Stream) RemoveOnClose() {
+	sf.s.mu.Lock()
+	defer sf.s.mu.Unlock()
+	sf.s.removal = true
+}
+
+//Stat returns the metadata of the file the stream belongs to
+func (sf *Stream) Stat() (meta *BoltFile, err error) {
+	err = sf.fs.db.View(func(tx *bolt.Tx) error {
+		meta, err = LoadBoltFile(tx.Bucket(BucketNameFiles), sf.ino)
+		if err == os.ErrNotExist {
+			return ErrNotExist
+		}
+
+		return err
+	})
+
+	return meta, err
+}
+
+//Close stores the stream's value and releases the handle's locks, the last
+//handle of a stream that is marked for removal removes its attribute
+func (sf *Stream) Close() error {
+	sf.fs.locks.UnlockAll(sf.owner)
+	err := sf.Flush()
+
+	st := sf.fs.streams
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, h := range sf.s.handles {
+		if h == sf {
+			sf.s.handles = append(sf.s.handles[:i:i], sf.s.handles[i+1:]...)
+			break
+		}
+	}
+
+	if len(sf.s.handles) > 0 {
+		return err
+	}
+
+	delete(st.streams, string(xattrKey(sf.ino, sf.name)))
+	if sf.s.removal {
+		if err := sf.fs.RemoveXattr(sf.name, sf.path...); err != nil && err != ErrNoXattr {
+			return fmt.Errorf("failed to remove stream '%s' on close: %v", sf.name, err)
+		}
+	}
+
+	return err
+}
+
+//openStream opens a stream as a dokan file, 'flag' holds the os.O_* flags
+//for the create disposition
+func (fs *BoltFS) openStream(flag int, access, share Access, name []byte, p ...[]byte) (*streamFile, error) {
+	s, err := fs.OpenStream(flag, access, share, name, p...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamFile{stream: s}, nil
+}
+
+//streamFile is the dokan representation of an opened stream
+type streamFile struct {
+	stream *Stream
+	EmptyFile
+}
+
+// ReadFile implements read for dokan.
+func (sf *streamFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
+	n, err := sf.stream.Read(offset, bs)
+	if err == io.EOF {
+		return n, nil //dokan signals the end of a file by a short read
+	}
+
+	return n, dokanError(err)
+}
+
+// WriteFile implements write for dokan.
+func (sf *streamFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (int, error) {
+	n, err := sf.stream.Write(offset, bs)
+	return n, dokanError(err)
+}
+
+// SetEndOfFile truncates or extends the stream.
+func (sf *streamFile) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	return dokanError(sf.stream.Truncate(length))
+}
+
+// SetAllocationSize truncates the stream if length is below its size.
+func (sf *streamFile) SetAllocationSize(ctx context.Context, fi *dokan.FileInfo, length int64) error {
+	if length >= sf.stream.Size() {
+		return nil
+	}
+
+	return dokanError(sf.stream.Truncate(length))
+}
+
+// LockFile at a specific offset and data length.
+func (sf *streamFile) LockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) error {
+	return dokanError(sf.stream.Lock(offset, length, true))
+}
+
+// UnlockFile at a specific offset and data length.
+func (sf *streamFile) UnlockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) error {
+	return dokanError(sf.stream.Unlock(offset, length))
+}
+
+// CanDeleteFile checks whether the stream can be deleted, it is removed in
+// Cleanup when FileInfo.IsDeleteOnClose is set.
+func (sf *streamFile) CanDeleteFile(ctx context.Context, fi *dokan.FileInfo) error {
+	return dokanError(sf.stream.CanRemove())
+}
+
+// FlushFileBuffers writes the stream back to its attribute.
+func (sf *streamFile) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) error {
+	return dokanError(sf.stream.Flush())
+}
+
+// Cleanup writes the stream back, or removes it when deleted on close.
+func (sf *streamFile) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
+	if fi.IsDeleteOnClose() {
+		sf.stream.RemoveOnClose()
+	}
+
+	//like NTFS the share mode is released on cleanup, not when closing
+	if err := sf.stream.Close(); err != nil {
+		debugf("failed to close stream '%s' on cleanup: %v", fi.Path(), err)
+	}
+}
+
+// GetFileInformation - corresponds to stat, the times are those of the file.
+func (sf *streamFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	meta, err := sf.stream.Stat()
+	if err != nil {
+		return nil, dokanError(err)
+	}
+
+	return &dokan.Stat{
+		Creation:       meta.Created,
+		LastAccess:     meta.Accessed,
+		LastWrite:      meta.Modified,
+		FileSize:       sf.stream.Size(),
+		FileIndex:      sf.stream.ino,
+		FileAttributes: dokan.FileAttributeNormal,
+	}, nil
+}
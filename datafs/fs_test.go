@@ -36,7 +36,7 @@ func testfs(t tester) *datafs.BoltFS {
 		t.Fatalf("failed to open bolt db: %v", err)
 	}
 
-	fs, err := datafs.NewBoltFS(logs, db)
+	fs, err := datafs.NewBoltFS(logs, db, nil)
 	if err != nil {
 		t.Fatalf("failed to create fs: %v", err)
 	}
@@ -46,6 +46,23 @@ func testfs(t tester) *datafs.BoltFS {
 
 func TestBasicOperations(t *testing.T) {
 	fs := testfs(t)
+	f, err := fs.Open(os.O_RDWR|os.O_CREATE, []byte("target.txt"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if _, err = f.Write(0, []byte("hello, link")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if err = fs.Symlink([]byte("target.txt"), false, []byte("link.txt")); err != nil {
+		t.Fatalf("failed to create link: %v", err)
+	}
+
 	mnt, err := dokan.Mount(&dokan.Config{FileSystem: fs, Path: mntpath})
 	if err != nil {
 		t.Fatal(err)
@@ -55,6 +72,7 @@ func TestBasicOperations(t *testing.T) {
 		"ReadNonExistingFile":   CaseOpenNonExistingFile,
 		"CreateNonExistingFile": CaseCreateNonExistingFile,
 		"ReadCreatedFile":       CaseReadCreatedFile,
+		"ReadThroughSymlink":    CaseReadThroughSymlink,
 	}
 	for name, fn := range cases {
 		t.Run(name, func(t *testing.T) {
@@ -99,3 +117,14 @@ func CaseReadCreatedFile(p string, t *testing.T) {
 		t.Errorf("output(len %d) should equal input(len %d)", len(output), len(input))
 	}
 }
+
+func CaseReadThroughSymlink(p string, t *testing.T) {
+	output, err := ioutil.ReadFile(filepath.Join(p, "link.txt"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(output) != "hello, link" {
+		t.Errorf("expected to read the target of the link, got: %q", output)
+	}
+}
@@ -0,0 +1,124 @@
+package datafs
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+//gcBatchSize is the number of chunks that are swept per write transaction
+//so the collector doesn't block file system writes for long
+const gcBatchSize = 1000
+
+//GCStats reports on a garbage collection run
+type GCStats struct {
+	Generation     uint64 //generation that was marked
+	Referenced     int    //number of distinct chunks referenced by files
+	Swept          int    //number of unreferenced chunks removed
+	ReclaimedBytes uint64 //number of stored bytes that were removed
+}
+
+//MarkFunc is called by the collector to mark every chunk key that is still
+//referenced by calling 'ref' for it
+type MarkFunc func(tx *bolt.Tx, ref func(k K)) error
+
+//Collect removes chunks that are no longer referenced by any file. The
+//store's generation is advanced before marking, chunks that are put or
+//referenced during the collection carry the new generation and are left
+//alone. This allows collecting while the file system is mounted by the
+//same process, bolt doesn't let others open the database: marking happens
+//on a read-only snapshot and sweeping in short write transactions.
+func (s *ChunkStore) Collect(db *bolt.DB, mark MarkFunc) (st GCStats, err error) {
+	if err = db.Update(func(tx *bolt.Tx) error {
+		st.Generation = s.generation(tx) + 1
+		return putCounter(tx.Bucket(BucketNameChunkStats), keyGeneration, st.Generation)
+	}); err != nil {
+		return st, fmt.Errorf("failed to advance generation: %v", err)
+	}
+
+	var candidates []K
+	if err = db.View(func(tx *bolt.Tx) error {
+		marked := map[string]struct{}{}
+		if err := mark(tx, func(k K) { marked[string(k)] = struct{}{} }); err != nil {
+			return fmt.Errorf("failed to mark chunks: %v", err)
+		}
+
+		st.Referenced = len(marked)
+		return tx.Bucket(BucketNameChunks).ForEach(func(kb, v []byte) error {
+			if _, ok := marked[string(kb)]; ok {
+				return nil
+			}
+
+			k := K(append([]byte(nil), kb...))
+			if k.Validate() != nil {
+				return nil //leave keys of unknown algorithms alone
+			}
+
+			hdr, _, err := decodeChunkRecord(k, v)
+			if err != nil {
+				return err
+			}
+
+			if hdr.Gen < st.Generation {
+				candidates = append(candidates, k)
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return st, err
+	}
+
+	for len(candidates) > 0 {
+		batch := candidates
+		if len(batch) > gcBatchSize {
+			batch = batch[:gcBatchSize]
+		}
+
+		candidates = candidates[len(batch):]
+		if err = db.Update(func(tx *bolt.Tx) error {
+			for _, k := range batch {
+				reclaimed, swept, err := s.sweep(tx, k, st.Generation)
+				if err != nil {
+					return err
+				}
+
+				if swept {
+					st.Swept++
+					st.ReclaimedBytes += reclaimed
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return st, fmt.Errorf("failed to sweep chunks: %v", err)
+		}
+	}
+
+	return st, nil
+}
+
+//sweep removes chunk 'k' unless it was referenced since generation 'gen'
+func (s *ChunkStore) sweep(tx *bolt.Tx, k K, gen uint64) (reclaimed uint64, swept bool, err error) {
+	b := tx.Bucket(BucketNameChunks)
+	v := b.Get(k[:])
+	if v == nil {
+		return 0, false, nil //released in the meantime
+	}
+
+	hdr, payload, err := decodeChunkRecord(k, v)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if hdr.Gen >= gen {
+		return 0, false, nil //referenced after marking
+	}
+
+	reclaimed = uint64(len(payload))
+	if err = b.Delete(k[:]); err != nil {
+		return 0, false, fmt.Errorf("failed to delete chunk '%s': %v", k, err)
+	}
+
+	return reclaimed, true, s.updateStats(tx, -1, -int64(hdr.Size*hdr.Refs), -int64(reclaimed))
+}
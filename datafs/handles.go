@@ -0,0 +1,187 @@
+package datafs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrSharingViolation is returned when opening a file conflicts with the share mode of another handle
+	ErrSharingViolation = errors.New("File is in use by another handle")
+
+	//ErrDeletePending is returned when opening a file that will be removed once its last handle is closed
+	ErrDeletePending = errors.New("File is about to be removed")
+)
+
+//Access is what a handle does with an opened file, the same bits describe
+//the share mode: what other handles of the file may do with it
+type Access uint8
+
+const (
+	//AccessRead reads the file's content
+	AccessRead Access = 1 << iota
+
+	//AccessWrite writes the file's content
+	AccessWrite
+
+	//AccessDelete removes or renames the file
+	AccessDelete
+
+	//AccessAll is every kind of access, as a share mode it never conflicts
+	AccessAll = AccessRead | AccessWrite | AccessDelete
+)
+
+//accessOf returns the access implied by the flags to Open
+func accessOf(flag int) Access {
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		return AccessWrite
+	case os.O_RDWR:
+		return AccessRead | AccessWrite
+	default:
+		return AccessRead
+	}
+}
+
+//conflicts reports whether a handle with access 'a' and share mode 's'
+//cannot be opened next to a handle with access 'oa' and share mode 'oshare'
+func conflicts(a, s, oa, oshare Access) bool {
+	return a&^oshare != 0 || oa&^s != 0
+}
+
+//openFile is the state of a file that has open handles
+type openFile struct {
+	mu      sync.Mutex  //serializes the handles' access to the buffer and metadata
+	buf     writeBuffer //writes of the handles that are not yet committed
+	timer   *time.Timer //commits the buffered writes once they are too old
+	handles []*File
+	removal [][]byte //path to remove when the last handle is closed
+}
+
+//handleTable keeps track of the opened files, it enforces share modes and
+//defers removals until the last handle of a file is closed as NTFS does
+type handleTable struct {
+	mu    sync.Mutex
+	files map[uint64]*openFile
+}
+
+func newHandleTable() *handleTable {
+	return &handleTable{files: map[uint64]*openFile{}}
+}
+
+//add registers the opened file 'f', it fails if its access or share mode
+//conflicts with the handles that are already open
+func (ht *handleTable) add(f *File) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	of := ht.files[f.ino]
+	if of == nil {
+		of = &openFile{}
+		ht.files[f.ino] = of
+	}
+
+	if of.removal != nil {
+		return ErrDeletePending
+	}
+
+	for _, h := range of.handles {
+		if f.access != 0 && h.access != 0 && conflicts(f.access, f.share, h.access, h.share) {
+			return ErrSharingViolation
+		}
+	}
+
+	f.open = of
+	of.handles = append(of.handles, f)
+	return nil
+}
+
+//remove unregisters 'f', if it was the last handle of the file the path
+//of a pending removal is returned
+func (ht *handleTable) remove(f *File) (removal [][]byte) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	of := ht.files[f.ino]
+	if of == nil {
+		return nil
+	}
+
+	for i, h := range of.handles {
+		if h == f {
+			of.handles = append(of.handles[:i:i], of.handles[i+1:]...)
+			break
+		}
+	}
+
+	if len(of.handles) > 0 {
+		return nil
+	}
+
+	delete(ht.files, f.ino)
+	return of.removal
+}
+
+//removeOnClose marks the file of 'f' for removal at path 'p' once all of
+//its handles are closed
+func (ht *handleTable) removeOnClose(f *File, p [][]byte) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if of := ht.files[f.ino]; of != nil {
+		of.removal = p
+	}
+}
+
+//replaceable returns an error if inode 'ino' has open handles, it is a
+//sharing violation if one of them doesn't share deletion
+func (ht *handleTable) replaceable(ino uint64) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	of := ht.files[ino]
+	if of == nil {
+		return nil
+	}
+
+	for _, h := range of.handles {
+		if h.access != 0 && h.share&AccessDelete == 0 {
+			return ErrSharingViolation
+		}
+	}
+
+	return ErrAccessDenied
+}
+
+//opened returns the state shared by the open handles of inode 'ino', such
+//that files listed while it is open include the buffered writes. A file
+//without open handles gets a state of its own.
+func (ht *handleTable) opened(ino uint64) *openFile {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if of := ht.files[ino]; of != nil {
+		return of
+	}
+
+	return &openFile{}
+}
+
+//each calls 'fn' for every open handle of inode 'ino'
+func (ht *handleTable) each(ino uint64, fn func(h *File)) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if of := ht.files[ino]; of != nil {
+		for _, h := range of.handles {
+			fn(h)
+		}
+	}
+}
+
+//handles returns the number of open handles of inode 'ino'
+func (ht *handleTable) handles(ino uint64) int {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if of := ht.files[ino]; of != nil {
+		return len(of.handles)
+	}
+
+	return 0
+}
@@ -0,0 +1,192 @@
+package datafs
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	//ErrUnknownHash is returned when a key or volume uses an unsupported hash algorithm
+	ErrUnknownHash = errors.New("Unknown hash algorithm")
+)
+
+//Hash identifies the algorithm that is used to derive chunk keys from
+//content, it is stored as the first byte of every key
+type Hash byte
+
+const (
+	//SHA1 keys content by its SHA-1 digest, only kept for existing volumes
+	SHA1 Hash = 1
+
+	//SHA256 keys content by its SHA-256 digest, the default for new volumes
+	SHA256 Hash = 2
+
+	//BLAKE2b256 keys content by its 32 byte BLAKE2b digest
+	BLAKE2b256 Hash = 3
+)
+
+var hashNames = map[Hash]string{
+	SHA1:       "sha1",
+	SHA256:     "sha256",
+	BLAKE2b256: "blake2b256",
+}
+
+//ParseHash returns the hash algorithm with the given name
+func ParseHash(name string) (Hash, error) {
+	for h, n := range hashNames {
+		if n == name {
+			return h, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%v: '%s'", ErrUnknownHash, name)
+}
+
+//String returns the name of the hash algorithm
+func (h Hash) String() string {
+	if name, ok := hashNames[h]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("hash(%d)", byte(h))
+}
+
+//Available reports whether the hash algorithm is supported
+func (h Hash) Available() bool {
+	_, ok := hashNames[h]
+	return ok
+}
+
+//New returns a hash.Hash that computes digests of this algorithm
+func (h Hash) New() hash.Hash {
+	switch h {
+	case SHA1:
+		return sha1.New()
+	case SHA256:
+		return sha256.New()
+	case BLAKE2b256:
+		d, _ := blake2b.New256(nil) //only fails for keys over 64 bytes
+		return d
+	default:
+		panic(fmt.Sprintf("datafs: %v", ErrUnknownHash))
+	}
+}
+
+//Size returns the number of bytes in a digest of this algorithm
+func (h Hash) Size() int {
+	return h.New().Size()
+}
+
+//Sum returns the tagged key of 'data'
+func (h Hash) Sum(data []byte) K {
+	d := h.New()
+	d.Write(data)
+	return h.key(d.Sum(nil))
+}
+
+//key tags a digest that was computed with this algorithm
+func (h Hash) key(digest []byte) K {
+	return K(append([]byte{byte(h)}, digest...))
+}
+
+//legacyKeySize is the size of the untagged SHA-1 keys of volumes that were
+//created before keys described their own hash algorithm
+const legacyKeySize = sha1.Size
+
+//Hash returns the algorithm that was used to compute the key
+func (k K) Hash() Hash {
+	if len(k) == legacyKeySize {
+		return SHA1
+	}
+
+	if len(k) == 0 {
+		return 0
+	}
+
+	return Hash(k[0])
+}
+
+//Digest returns the digest without the algorithm tag
+func (k K) Digest() []byte {
+	if len(k) == legacyKeySize {
+		return k
+	}
+
+	if len(k) == 0 {
+		return nil
+	}
+
+	return k[1:]
+}
+
+//Validate checks if the key is tagged with a known algorithm and has the
+//digest size that belongs to it
+func (k K) Validate() error {
+	if len(k) == legacyKeySize {
+		return nil
+	}
+
+	h := k.Hash()
+	if !h.Available() {
+		return ErrUnknownHash
+	}
+
+	if len(k.Digest()) != h.Size() {
+		return fmt.Errorf("%s key has unexpected digest length %d", h, len(k.Digest()))
+	}
+
+	return nil
+}
+
+//Equal reports whether two keys are the same
+func (k K) Equal(o K) bool {
+	return string(k) == string(o)
+}
+
+//String returns the algorithm name and hex digest of the key, legacy SHA-1
+//keys are returned as only the hex digest
+func (k K) String() string {
+	if len(k) == legacyKeySize {
+		return hex.EncodeToString(k)
+	}
+
+	return k.Hash().String() + ":" + hex.EncodeToString(k.Digest())
+}
+
+//MarshalText encodes the key as text so it can be stored in file metadata
+func (k K) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+//UnmarshalText decodes a key that was encoded with MarshalText
+func (k *K) UnmarshalText(text []byte) error {
+	name, digest := "", string(text)
+	if i := strings.IndexByte(digest, ':'); i >= 0 {
+		name, digest = digest[:i], digest[i+1:]
+	}
+
+	data, err := hex.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("failed to decode chunk key: %v", err)
+	}
+
+	if name == "" {
+		*k = K(data) //legacy untagged key
+	} else {
+		h, err := ParseHash(name)
+		if err != nil {
+			return err
+		}
+
+		*k = h.key(data)
+	}
+
+	return k.Validate()
+}
@@ -0,0 +1,92 @@
+package datafs_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/advanderveer/datafs/datafs"
+	"github.com/boltdb/bolt"
+)
+
+func TestHashDigests(t *testing.T) {
+	for _, c := range []struct {
+		h      datafs.Hash
+		input  string
+		digest string
+	}{
+		{datafs.SHA1, "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{datafs.SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{datafs.BLAKE2b256, "abc", "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{datafs.BLAKE2b256, "", "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+	} {
+		k := c.h.Sum([]byte(c.input))
+		if k.Hash() != c.h {
+			t.Errorf("expected key to be tagged with %s, got: %s", c.h, k.Hash())
+		}
+
+		if digest := hex.EncodeToString(k.Digest()); digest != c.digest {
+			t.Errorf("unexpected %s digest of %q: %s", c.h, c.input, digest)
+		}
+	}
+}
+
+func TestKeyText(t *testing.T) {
+	for _, h := range []datafs.Hash{datafs.SHA1, datafs.SHA256, datafs.BLAKE2b256} {
+		k := h.Sum([]byte("hello, world"))
+		data, err := json.Marshal(datafs.ChunkRef{K: k})
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+
+		var ref datafs.ChunkRef
+		if err = json.Unmarshal(data, &ref); err != nil {
+			t.Fatalf("failed to unmarshal key: %v", err)
+		}
+
+		if !ref.K.Equal(k) {
+			t.Errorf("expected %s key to survive encoding, got: %s", h, ref.K)
+		}
+	}
+
+	var legacy datafs.K
+	if err := legacy.UnmarshalText([]byte("a9993e364706816aba3e25717850c26c9cd0d89d")); err != nil || legacy.Hash() != datafs.SHA1 {
+		t.Errorf("expected untagged key to decode as legacy SHA-1, got: %s (%v)", legacy.Hash(), err)
+	}
+
+	var unknown datafs.K
+	if err := unknown.UnmarshalText([]byte("md5:900150983cd24fb0d6963f7d28e17f72")); err == nil {
+		t.Errorf("expected key of unknown algorithm to fail decoding")
+	}
+}
+
+func TestVolumeHash(t *testing.T) {
+	db := testdb(t)
+	defer db.Close()
+
+	s, err := datafs.NewChunkStore(db, &datafs.Options{Hash: datafs.BLAKE2b256})
+	if err != nil {
+		t.Fatalf("failed to create chunk store: %v", err)
+	}
+
+	var k datafs.K
+	if err = db.Update(func(tx *bolt.Tx) error {
+		k, err = s.Put(tx, datafs.Chunk("hello, world"))
+		return err
+	}); err != nil {
+		t.Fatalf("failed to put chunk: %v", err)
+	}
+
+	if k.Hash() != datafs.BLAKE2b256 {
+		t.Errorf("expected chunk to be keyed with BLAKE2b, got: %s", k.Hash())
+	}
+
+	s, err = datafs.NewChunkStore(db, &datafs.Options{Hash: datafs.SHA256})
+	if err != nil {
+		t.Fatalf("failed to reopen chunk store: %v", err)
+	}
+
+	if s.Hash() != datafs.BLAKE2b256 {
+		t.Errorf("expected the volume to keep its hash algorithm, got: %s", s.Hash())
+	}
+}
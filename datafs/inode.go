@@ -0,0 +1,244 @@
+package datafs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+//rootIno is the inode number of the root directory, inode numbers are
+//allocated from the sequence of the files bucket and are never reused. The
+//sequence is persisted with the bucket so numbers stay unique across
+//remounts, and renames keep them as they only move directory entries.
+//Windows reports the inode number as the file index.
+const rootIno uint64 = 1
+
+//inoKey returns the key of inode 'ino', it is big-endian encoded such that
+//records are ordered by inode number
+func inoKey(ino uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, ino)
+	return k
+}
+
+//direntKey returns the key of the entry 'name' in directory 'parent', all
+//entries of a directory share the inode of the directory as prefix
+func direntKey(parent uint64, name []byte) []byte {
+	return append(inoKey(parent), name...)
+}
+
+//checkName returns ErrInvalidName if 'name' cannot be used as a path element
+func checkName(name []byte) error {
+	if len(name) == 0 || bytes.ContainsAny(name, "/\\\x00") || bytes.Equal(name, []byte(".")) || bytes.Equal(name, []byte("..")) {
+		return ErrInvalidName
+	}
+
+	return nil
+}
+
+//lookup returns the inode of entry 'name' in directory 'parent', or 0 if
+//the directory has no such entry
+func lookup(tx *bolt.Tx, parent uint64, name []byte) uint64 {
+	v := tx.Bucket(BucketNameDirents).Get(direntKey(parent, name))
+	if v == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(v)
+}
+
+//resolve walks the directory entries for the joined path elements 'p' and
+//returns the inode of the directory holding the last element and of the
+//element itself. If only the last element doesn't exist 'ino' is 0, if a
+//directory before it doesn't exist ErrPathNotFound is returned. The root
+//directory has no parent.
+func resolve(tx *bolt.Tx, p ...[]byte) (parent, ino uint64, err error) {
+	for _, name := range p {
+		if err = checkName(name); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	ino = rootIno
+	for _, name := range p {
+		if ino == 0 {
+			return 0, 0, ErrPathNotFound
+		}
+
+		parent = ino
+		if ino = lookup(tx, parent, name); ino != 0 {
+			continue //only directories have entries
+		}
+
+		dir, err := LoadBoltFile(tx.Bucket(BucketNameFiles), parent)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to load directory %d: %v", parent, err)
+		}
+
+		if !dir.IsDirectory || dir.IsSymlink() {
+			return 0, 0, ErrNotDirectory //nothing can be created in directory links
+		}
+	}
+
+	return parent, ino, nil
+}
+
+//createInode stores 'meta' under a newly allocated inode number
+func createInode(tx *bolt.Tx, meta *BoltFile) (ino uint64, err error) {
+	b := tx.Bucket(BucketNameFiles)
+	ino, err = b.NextSequence()
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate inode: %v", err)
+	}
+
+	return ino, meta.Save(b, ino)
+}
+
+//link adds an entry 'name' for inode 'ino' to directory 'parent'
+func link(tx *bolt.Tx, parent uint64, name []byte, ino uint64) error {
+	return tx.Bucket(BucketNameDirents).Put(direntKey(parent, name), inoKey(ino))
+}
+
+//unlink removes the entry 'name' from directory 'parent'
+func unlink(tx *bolt.Tx, parent uint64, name []byte) error {
+	return tx.Bucket(BucketNameDirents).Delete(direntKey(parent, name))
+}
+
+//within reports whether the path elements 'p' lead through, or to, inode 'ino'
+func within(tx *bolt.Tx, ino uint64, p ...[]byte) bool {
+	cur := rootIno
+	for _, name := range p {
+		if cur == ino {
+			return true
+		}
+
+		if cur = lookup(tx, cur, name); cur == 0 {
+			return false
+		}
+	}
+
+	return cur == ino
+}
+
+//removeInode drops a link of inode 'ino', the entry itself is removed by
+//the caller. When the last link is dropped the inode is deleted and the
+//chunks of its content are released.
+func removeInode(tx *bolt.Tx, chunks *ChunkStore, ino uint64) error {
+	b := tx.Bucket(BucketNameFiles)
+	meta, err := LoadBoltFile(b, ino)
+	if err != nil {
+		return fmt.Errorf("failed to load inode %d: %v", ino, err)
+	}
+
+	if meta.Links() > 1 {
+		meta.Nlink = meta.Links() - 1
+		return meta.Save(b, ino)
+	}
+
+	if err = chunks.Release(tx, chunkKeys(meta.Chunks)); err != nil {
+		return fmt.Errorf("failed to release chunks of inode %d: %v", ino, err)
+	}
+
+	if err = removeXattrs(tx, chunks, ino); err != nil {
+		return err
+	}
+
+	return b.Delete(inoKey(ino))
+}
+
+//setupInodes creates the inode, directory entry and attribute buckets and
+//the root directory, volumes that still key their metadata by path are migrated
+func setupInodes(tx *bolt.Tx) error {
+	for _, name := range [][]byte{BucketNameDirents, BucketNameXattrs} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	b, err := tx.CreateBucketIfNotExists(BucketNameFiles)
+	if err != nil {
+		return err
+	}
+
+	if b.Get(inoKey(rootIno)) == nil {
+		ino, err := createInode(tx, NewBoltFile(true))
+		if err != nil {
+			return fmt.Errorf("failed to create root: %v", err)
+		}
+
+		if ino != rootIno {
+			return fmt.Errorf("root directory was allocated inode %d, expected %d", ino, rootIno)
+		}
+	}
+
+	return migrateMetadata(tx)
+}
+
+//migrateMetadata moves the records of the path-keyed metadata bucket into
+//inodes and directory entries and removes the bucket afterwards. Older
+//versions separated path elements by a backslash, newer by a slash.
+func migrateMetadata(tx *bolt.Tx) error {
+	old := tx.Bucket(BucketNameMetadata)
+	if old == nil {
+		return nil
+	}
+
+	type record struct {
+		path  []byte
+		elems [][]byte
+		data  []byte
+	}
+
+	var records []record
+	if err := old.ForEach(func(k, v []byte) error {
+		r := record{path: append([]byte(nil), k...), data: append([]byte(nil), v...)}
+		for _, e := range bytes.FieldsFunc(r.path, func(c rune) bool { return c == '/' || c == '\\' }) {
+			r.elems = append(r.elems, e)
+		}
+
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	//parents are migrated before their children
+	sort.SliceStable(records, func(i, j int) bool { return len(records[i].elems) < len(records[j].elems) })
+
+	b := tx.Bucket(BucketNameFiles)
+	for _, r := range records {
+		meta := &BoltFile{}
+		if err := json.Unmarshal(r.data, meta); err != nil {
+			return fmt.Errorf("failed to deserialize file '%s': %v", r.path, err)
+		}
+
+		if len(r.elems) == 0 {
+			if err := meta.Save(b, rootIno); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		parent, ino, err := resolve(tx, r.elems...)
+		if err != nil {
+			return fmt.Errorf("failed to migrate '%s': %v", r.path, err)
+		} else if ino != 0 {
+			return fmt.Errorf("failed to migrate '%s': %v", r.path, ErrExists)
+		}
+
+		if ino, err = createInode(tx, meta); err != nil {
+			return err
+		}
+
+		if err = link(tx, parent, r.elems[len(r.elems)-1], ino); err != nil {
+			return err
+		}
+	}
+
+	return tx.DeleteBucket(BucketNameMetadata)
+}
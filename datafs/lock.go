@@ -0,0 +1,127 @@
+package datafs
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	//ErrLockConflict is returned when a lock overlaps a conflicting lock
+	ErrLockConflict = errors.New("Range is already locked")
+
+	//ErrNotLocked is returned when unlocking a range that the handle didn't lock
+	ErrNotLocked = errors.New("Range is not locked")
+
+	//ErrRangeLocked is returned when reading or writing a range that is locked by another handle
+	ErrRangeLocked = errors.New("Range is locked by another handle")
+)
+
+//Lock is a byte range of a file that is locked through an opened file
+type Lock struct {
+	Owner     *File
+	Offset    int64
+	Length    int64
+	Exclusive bool
+}
+
+func (l Lock) overlaps(off, n int64) bool {
+	return n > 0 && l.Length > 0 && l.Offset < off+n && off < l.Offset+l.Length
+}
+
+//LockManager keeps track of the byte-range locks on files while the file
+//system is in use, locks are held by opened files and are not persisted.
+//Like on Windows, locks are mandatory: exclusive locks prevent other handles
+//from reading and writing the range, shared locks prevent everyone from
+//writing it.
+type LockManager struct {
+	mu    sync.Mutex
+	locks map[uint64][]Lock
+}
+
+//NewLockManager sets up a lock manager without any locks
+func NewLockManager() *LockManager {
+	return &LockManager{locks: map[uint64][]Lock{}}
+}
+
+//Lock locks 'n' bytes at offset 'off' of the opened file 'f'. An exclusive
+//lock conflicts with any overlapping lock, a shared lock with overlapping
+//exclusive locks of other handles.
+func (lm *LockManager) Lock(f *File, off, n int64, exclusive bool) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, l := range lm.locks[f.ino] {
+		if !l.overlaps(off, n) {
+			continue
+		}
+
+		if exclusive || (l.Exclusive && l.Owner != f) {
+			return ErrLockConflict
+		}
+	}
+
+	lm.locks[f.ino] = append(lm.locks[f.ino], Lock{Owner: f, Offset: off, Length: n, Exclusive: exclusive})
+	return nil
+}
+
+//Unlock removes a lock of 'f', the range must match the locked range exactly
+func (lm *LockManager) Unlock(f *File, off, n int64) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	locks := lm.locks[f.ino]
+	for i, l := range locks {
+		if l.Owner == f && l.Offset == off && l.Length == n {
+			lm.set(f.ino, append(locks[:i:i], locks[i+1:]...))
+			return nil
+		}
+	}
+
+	return ErrNotLocked
+}
+
+//UnlockAll removes all locks of 'f', it is called when the file is closed
+func (lm *LockManager) UnlockAll(f *File) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	var kept []Lock
+	for _, l := range lm.locks[f.ino] {
+		if l.Owner != f {
+			kept = append(kept, l)
+		}
+	}
+
+	lm.set(f.ino, kept)
+}
+
+//Locks returns the locks that are held on the file with inode 'ino'
+func (lm *LockManager) Locks(ino uint64) []Lock {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return append([]Lock(nil), lm.locks[ino]...)
+}
+
+//check returns ErrRangeLocked if 'f' may not read, or write, 'n' bytes at
+//offset 'off' because of the locks on the file
+func (lm *LockManager) check(f *File, off, n int64, write bool) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, l := range lm.locks[f.ino] {
+		if !l.overlaps(off, n) {
+			continue
+		}
+
+		if (l.Exclusive && l.Owner != f) || (!l.Exclusive && write) {
+			return ErrRangeLocked
+		}
+	}
+
+	return nil
+}
+
+func (lm *LockManager) set(ino uint64, locks []Lock) {
+	if len(locks) == 0 {
+		delete(lm.locks, ino)
+		return
+	}
+
+	lm.locks[ino] = locks
+}
@@ -0,0 +1,292 @@
+package datafs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	//ErrInvalidSID is returned when a security identifier is malformed
+	ErrInvalidSID = errors.New("Invalid security identifier")
+)
+
+//Access rights of ACEs that map to POSIX permission bits
+const (
+	rightReadData      = 0x00000001
+	rightWriteData     = 0x00000002
+	rightAppendData    = 0x00000004
+	rightExecute       = 0x00000020
+	rightGenericAll    = 0x10000000
+	rightGenericExec   = 0x20000000
+	rightGenericWrite  = 0x40000000
+	rightGenericRead   = 0x80000000
+	rightFileRead      = 0x00120089 //FILE_GENERIC_READ
+	rightFileWrite     = 0x00120116 //FILE_GENERIC_WRITE
+	rightFileExecute   = 0x001200A0 //FILE_GENERIC_EXECUTE
+	rightOwnerControls = 0x000D0000 //DELETE, WRITE_DAC and WRITE_OWNER
+)
+
+//Security is the ownership and access control of a file, it is stored with
+//the file's metadata and presented as a security descriptor on Windows
+type Security struct {
+	Owner SID   `json:"o,omitempty"`
+	Group SID   `json:"g,omitempty"`
+	DACL  []ACE `json:"d,omitempty"` //without entries everyone has full access
+}
+
+//ACE is an access control entry that allows a trustee the rights in 'Mask'
+type ACE struct {
+	SID  SID    `json:"s"`
+	Mask uint32 `json:"m"`
+}
+
+//Validate returns an error if any of the identifiers is malformed
+func (sec *Security) Validate() error {
+	for _, sid := range []SID{sec.Owner, sec.Group} {
+		if sid == nil {
+			continue
+		}
+
+		if err := sid.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, ace := range sec.DACL {
+		if err := ace.SID.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//SID is a Windows security identifier in its binary form
+type SID []byte
+
+//Well-known identifiers, Unix users and groups are mapped into their own
+//authorities as Samba and NFS do: S-1-22-1-<uid> and S-1-22-2-<gid>
+var (
+	SIDEveryone = MustParseSID("S-1-1-0")
+
+	unixUserAuthority  = []uint32{22, 1}
+	unixGroupAuthority = []uint32{22, 2}
+)
+
+//ParseSID parses the string form of a security identifier, e.g. S-1-5-32-544
+func ParseSID(s string) (sid SID, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 3 || parts[0] != "S" || parts[1] != "1" || len(parts)-3 > 15 {
+		return nil, fmt.Errorf("%v: '%s'", ErrInvalidSID, s)
+	}
+
+	authority, err := strconv.ParseUint(parts[2], 10, 48)
+	if err != nil {
+		return nil, fmt.Errorf("%v: '%s'", ErrInvalidSID, s)
+	}
+
+	sid = make(SID, 8, 8+4*(len(parts)-3))
+	sid[0], sid[1] = 1, byte(len(parts)-3)
+	for i := 0; i < 6; i++ {
+		sid[7-i] = byte(authority >> (8 * uint(i)))
+	}
+
+	for _, part := range parts[3:] {
+		sub, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%v: '%s'", ErrInvalidSID, s)
+		}
+
+		sid = append(sid, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(sid[len(sid)-4:], uint32(sub))
+	}
+
+	return sid, nil
+}
+
+//MustParseSID parses a security identifier and panics if it is malformed
+func MustParseSID(s string) SID {
+	sid, err := ParseSID(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return sid
+}
+
+//Validate returns ErrInvalidSID if the identifier is malformed
+func (sid SID) Validate() error {
+	if len(sid) < 8 || sid[0] != 1 || len(sid) != 8+4*int(sid[1]) {
+		return ErrInvalidSID
+	}
+
+	return nil
+}
+
+//authority returns the identifier authority of the SID
+func (sid SID) authority() (a uint64) {
+	for _, b := range sid[2:8] {
+		a = a<<8 | uint64(b)
+	}
+
+	return a
+}
+
+//subAuthorities returns the sub authorities of the SID
+func (sid SID) subAuthorities() (subs []uint32) {
+	for i := 8; i+4 <= len(sid); i += 4 {
+		subs = append(subs, binary.LittleEndian.Uint32(sid[i:]))
+	}
+
+	return subs
+}
+
+//String returns the string form of the SID, e.g. S-1-1-0
+func (sid SID) String() string {
+	if sid.Validate() != nil {
+		return fmt.Sprintf("invalid-sid(%x)", []byte(sid))
+	}
+
+	s := fmt.Sprintf("S-1-%d", sid.authority())
+	for _, sub := range sid.subAuthorities() {
+		s += fmt.Sprintf("-%d", sub)
+	}
+
+	return s
+}
+
+//MarshalText encodes the SID in its string form
+func (sid SID) MarshalText() ([]byte, error) {
+	if err := sid.Validate(); err != nil {
+		return nil, err
+	}
+
+	return []byte(sid.String()), nil
+}
+
+//UnmarshalText decodes the string form of a SID
+func (sid *SID) UnmarshalText(text []byte) (err error) {
+	*sid, err = ParseSID(string(text))
+	return err
+}
+
+//Equal reports whether both identifiers are the same
+func (sid SID) Equal(other SID) bool {
+	return string(sid) == string(other)
+}
+
+func unixSID(authority []uint32, id uint32) SID {
+	sid := MustParseSID(fmt.Sprintf("S-1-%d-%d", authority[0], authority[1]))
+	sid[1]++
+	sid = append(sid, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(sid[len(sid)-4:], id)
+	return sid
+}
+
+//UnixUserSID returns the identifier of Unix user 'uid'
+func UnixUserSID(uid uint32) SID {
+	return unixSID(unixUserAuthority, uid)
+}
+
+//UnixGroupSID returns the identifier of Unix group 'gid'
+func UnixGroupSID(gid uint32) SID {
+	return unixSID(unixGroupAuthority, gid)
+}
+
+//unixID returns the Unix id of a SID in 'authority', if it is one
+func (sid SID) unixID(authority []uint32) (id uint32, ok bool) {
+	if sid.Validate() != nil || sid.authority() != uint64(authority[0]) {
+		return 0, false
+	}
+
+	subs := sid.subAuthorities()
+	if len(subs) != 2 || subs[0] != authority[1] {
+		return 0, false
+	}
+
+	return subs[1], true
+}
+
+//UnixNobody is the uid and gid that identifiers without a Unix mapping get
+const UnixNobody = 65534
+
+//UnixSecurity returns the security of a file that is owned by 'uid' and
+//'gid' with permission bits 'mode'
+func UnixSecurity(uid, gid uint32, mode os.FileMode) *Security {
+	sec := &Security{Owner: UnixUserSID(uid), Group: UnixGroupSID(gid)}
+	for i, sid := range []SID{sec.Owner, sec.Group, SIDEveryone} {
+		perm := uint32(mode.Perm()>>uint(6-3*i)) & 7
+		var mask uint32
+		if perm&4 != 0 {
+			mask |= rightFileRead
+		}
+
+		if perm&2 != 0 {
+			mask |= rightFileWrite
+		}
+
+		if perm&1 != 0 {
+			mask |= rightFileExecute
+		}
+
+		if i == 0 {
+			mask |= rightOwnerControls
+		}
+
+		sec.DACL = append(sec.DACL, ACE{SID: sid, Mask: mask})
+	}
+
+	return sec
+}
+
+//Unix returns the POSIX owner, group and permission bits of the security.
+//Identifiers that are not Unix users or groups map to UnixNobody and the
+//permissions of the owner, group and others are taken from the entries for
+//the owner, the group and Everyone. Without entries everyone has full access.
+func (sec *Security) Unix() (uid, gid uint32, mode os.FileMode) {
+	uid, gid = UnixNobody, UnixNobody
+	if sec == nil {
+		return uid, gid, 0777
+	}
+
+	if id, ok := sec.Owner.unixID(unixUserAuthority); ok {
+		uid = id
+	}
+
+	if id, ok := sec.Group.unixID(unixGroupAuthority); ok {
+		gid = id
+	}
+
+	if len(sec.DACL) == 0 {
+		return uid, gid, 0777
+	}
+
+	for _, ace := range sec.DACL {
+		for i, sid := range []SID{sec.Owner, sec.Group, SIDEveryone} {
+			if sid == nil || !ace.SID.Equal(sid) {
+				continue
+			}
+
+			var perm os.FileMode
+			if ace.Mask&(rightReadData|rightGenericRead|rightGenericAll) != 0 {
+				perm |= 4
+			}
+
+			if ace.Mask&(rightWriteData|rightAppendData|rightGenericWrite|rightGenericAll) != 0 {
+				perm |= 2
+			}
+
+			if ace.Mask&(rightExecute|rightGenericExec|rightGenericAll) != 0 {
+				perm |= 1
+			}
+
+			mode |= perm << uint(6-3*i)
+		}
+	}
+
+	return uid, gid, mode
+}
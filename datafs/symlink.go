@@ -0,0 +1,162 @@
+package datafs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//ErrNotSymlink is returned when reading the target of a file that is not a symbolic link
+	ErrNotSymlink = errors.New("Not a symbolic link")
+
+	//ErrTooManyLinks is returned when evaluating a path follows too many symbolic links
+	ErrTooManyLinks = errors.New("Too many levels of symbolic links")
+)
+
+//maxSymlinks is the number of links EvalSymlinks follows before giving up
+const maxSymlinks = 40
+
+//Symlink creates a symbolic link at joined path 'p' that points to 'target'.
+//Like on Windows a link is either a file or a directory link: a directory
+//link is an empty directory that nothing can be created in. Targets that
+//start with a separator are relative to the root of the volume, others to
+//the directory of the link.
+func (fs *FileSystem) Symlink(target []byte, dir bool, p ...[]byte) error {
+	if len(target) == 0 {
+		return ErrInvalidName
+	}
+
+	if len(p) == 0 {
+		return ErrExists
+	}
+
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		parent, ino, err := resolve(tx, p...)
+		if err != nil {
+			return err
+		} else if ino != 0 {
+			return ErrExists
+		}
+
+		pmeta, err := LoadBoltFile(tx.Bucket(BucketNameFiles), parent)
+		if err != nil {
+			return fmt.Errorf("failed to load directory %d: %v", parent, err)
+		}
+
+		meta := NewBoltFile(dir)
+		meta.Target = append([]byte(nil), target...)
+		meta.Security = pmeta.Security
+		if ino, err = createInode(tx, meta); err != nil {
+			return err
+		}
+
+		return link(tx, parent, p[len(p)-1], ino)
+	})
+}
+
+//Readlink returns the target of the symbolic link at joined path 'p'
+func (fs *FileSystem) Readlink(p ...[]byte) (target []byte, err error) {
+	err = fs.db.View(func(tx *bolt.Tx) error {
+		_, ino, err := resolve(tx, p...)
+		if err != nil {
+			return err
+		} else if ino == 0 {
+			return ErrNotExist
+		}
+
+		meta, err := LoadBoltFile(tx.Bucket(BucketNameFiles), ino)
+		if err != nil {
+			return fmt.Errorf("failed to load '%s': %v", joinPath(p...), err)
+		}
+
+		if !meta.IsSymlink() {
+			return ErrNotSymlink
+		}
+
+		target = meta.Target
+		return nil
+	})
+
+	return target, err
+}
+
+//EvalSymlinks returns the path elements of joined path 'p' after following
+//all symbolic links in it, every element of the path must exist
+func (fs *FileSystem) EvalSymlinks(p ...[]byte) (resolved [][]byte, err error) {
+	err = fs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketNameFiles)
+		todo := append([][]byte(nil), p...)
+		for n := 0; len(todo) > 0; {
+			name := todo[0]
+			todo = todo[1:]
+			switch {
+			case bytes.Equal(name, []byte(".")):
+				continue
+			case bytes.Equal(name, []byte("..")):
+				if len(resolved) > 0 {
+					resolved = resolved[:len(resolved)-1]
+				}
+
+				continue
+			}
+
+			_, ino, err := resolve(tx, append(resolved, name)...)
+			if err != nil {
+				return err
+			} else if ino == 0 {
+				return ErrNotExist
+			}
+
+			meta, err := LoadBoltFile(b, ino)
+			if err != nil {
+				return fmt.Errorf("failed to load inode %d: %v", ino, err)
+			}
+
+			if !meta.IsSymlink() {
+				resolved = append(resolved, name)
+				continue
+			}
+
+			if n++; n > maxSymlinks {
+				return ErrTooManyLinks
+			}
+
+			if isSeparator(rune(meta.Target[0])) {
+				resolved = nil
+			}
+
+			todo = append(bytes.FieldsFunc(meta.Target, isSeparator), todo...)
+		}
+
+		return nil
+	})
+
+	return resolved, err
+}
+
+//FollowSymlinks returns the path elements of joined path 'p' after following
+//the symbolic links in it like EvalSymlinks, except that the last element
+//doesn't have to exist such that it can be created in the linked directory
+func (fs *FileSystem) FollowSymlinks(p ...[]byte) ([][]byte, error) {
+	resolved, err := fs.EvalSymlinks(p...)
+	if err != ErrNotExist || len(p) == 0 {
+		return resolved, err
+	}
+
+	dir, err := fs.EvalSymlinks(p[:len(p)-1]...)
+	if err == ErrNotExist {
+		return nil, ErrPathNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return append(dir, p[len(p)-1]), nil
+}
+
+//isSeparator reports whether 'c' separates the elements of a link target
+func isSeparator(c rune) bool {
+	return c == '/' || c == '\\'
+}
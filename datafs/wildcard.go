@@ -0,0 +1,92 @@
+package datafs
+
+import (
+	"bytes"
+)
+
+//Wildcards in directory listing patterns, besides '*' and '?' Windows
+//translates the wildcards of DOS programs into the following
+const (
+	dosStar = '<' //any characters up to the last period of the name
+	dosQM   = '>' //any single character, or none at a period or the end
+	dosDot  = '"' //a period, or nothing at the end of the name
+)
+
+//wildcards are the pattern characters that don't match themselves
+const wildcards = "*?<>\""
+
+//patternPrefix returns the literal part of 'pattern' before the first
+//wildcard, only names that start with it can match
+func patternPrefix(pattern []byte) []byte {
+	if i := bytes.IndexAny(pattern, wildcards); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
+
+//matchPattern reports whether 'name' matches the Windows wildcard 'pattern'
+//as FsRtlIsNameInExpression would, but case-sensitive as the volume is. An
+//empty pattern matches every name.
+func matchPattern(pattern, name []byte) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+
+	p, n := []rune(string(pattern)), []rune(string(name))
+	lastDot := -1
+	for i, c := range n {
+		if c == '.' {
+			lastDot = i
+		}
+	}
+
+	//matched[i][j] caches whether p[i:] matches n[j:], 0 is unknown
+	matched := make([][]int8, len(p)+1)
+	for i := range matched {
+		matched[i] = make([]int8, len(n)+1)
+	}
+
+	var match func(i, j int) bool
+	match = func(i, j int) (ok bool) {
+		if matched[i][j] != 0 {
+			return matched[i][j] > 0
+		}
+
+		defer func() {
+			matched[i][j] = -1
+			if ok {
+				matched[i][j] = 1
+			}
+		}()
+
+		if i == len(p) {
+			return j == len(n)
+		}
+
+		switch p[i] {
+		case '*':
+			return match(i+1, j) || (j < len(n) && match(i, j+1))
+		case '?':
+			return j < len(n) && match(i+1, j+1)
+		case dosStar:
+			return match(i+1, j) || (j < len(n) && j != lastDot && match(i, j+1))
+		case dosQM:
+			if j == len(n) || n[j] == '.' {
+				return match(i+1, j)
+			}
+
+			return match(i+1, j+1)
+		case dosDot:
+			if j == len(n) {
+				return match(i+1, j)
+			}
+
+			return n[j] == '.' && match(i+1, j+1)
+		default:
+			return j < len(n) && n[j] == p[i] && match(i+1, j+1)
+		}
+	}
+
+	return match(0, 0)
+}
@@ -0,0 +1,177 @@
+package datafs
+
+import (
+	"io"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//extent is a dirty range of file content that is not yet chunked
+type extent struct {
+	off  int64
+	data []byte
+}
+
+func (e extent) end() int64 {
+	return e.off + int64(len(e.data))
+}
+
+//writeBuffer accumulates the writes to an opened file as a sorted list of
+//non-overlapping extents such that they can be chunked together instead of
+//one write at a time. It is shared by all handles of the file, such that
+//they read each other's writes before they are committed.
+type writeBuffer struct {
+	extents []extent
+	n       int       //number of buffered bytes
+	since   time.Time //time of the oldest buffered write
+	last    time.Time //time of the newest buffered write
+}
+
+//write buffers 'p' at offset 'off', merging it with the extents it touches
+func (wb *writeBuffer) write(off int64, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	wb.last = time.Now()
+	if len(wb.extents) == 0 {
+		wb.since = wb.last
+	}
+
+	merged := extent{off: off, data: p}
+	first, last := len(wb.extents), -1
+	for i, e := range wb.extents {
+		if e.end() < merged.off || e.off > off+int64(len(p)) {
+			continue //not overlapping or adjacent
+		}
+
+		if i < first {
+			first = i
+		}
+
+		last = i
+	}
+
+	if last >= 0 {
+		start, end := off, off+int64(len(p))
+		if wb.extents[first].off < start {
+			start = wb.extents[first].off
+		}
+
+		if wb.extents[last].end() > end {
+			end = wb.extents[last].end()
+		}
+
+		merged = extent{off: start, data: make([]byte, end-start)}
+		for _, e := range wb.extents[first : last+1] {
+			copy(merged.data[e.off-start:], e.data)
+			wb.n -= len(e.data)
+		}
+
+		copy(merged.data[off-start:], p)
+		wb.extents = append(wb.extents[:first], wb.extents[last+1:]...)
+	} else {
+		merged.data = append([]byte(nil), p...)
+	}
+
+	i := 0
+	for i < len(wb.extents) && wb.extents[i].off < merged.off {
+		i++
+	}
+
+	wb.extents = append(wb.extents, extent{})
+	copy(wb.extents[i+1:], wb.extents[i:])
+	wb.extents[i] = merged
+	wb.n += len(merged.data)
+}
+
+//overlay copies the buffered bytes that fall in [off, off+len(p)) into 'p'
+func (wb *writeBuffer) overlay(off int64, p []byte) {
+	end := off + int64(len(p))
+	for _, e := range wb.extents {
+		if e.end() <= off || e.off >= end {
+			continue
+		}
+
+		if e.off >= off {
+			copy(p[e.off-off:], e.data)
+		} else {
+			copy(p, e.data[off-e.off:])
+		}
+	}
+}
+
+//dirty returns whether the byte at 'off' is buffered and the offset at which
+//that changes
+func (wb *writeBuffer) dirty(off int64) (dirty bool, next int64) {
+	for _, e := range wb.extents {
+		if e.end() <= off {
+			continue
+		}
+
+		if e.off <= off {
+			return true, e.end()
+		}
+
+		return false, e.off
+	}
+
+	return false, math.MaxInt64
+}
+
+//start returns the offset of the first dirty byte
+func (wb *writeBuffer) start() int64 {
+	if len(wb.extents) == 0 {
+		return 0
+	}
+
+	return wb.extents[0].off
+}
+
+//end returns the offset after the last dirty byte
+func (wb *writeBuffer) end() int64 {
+	if len(wb.extents) == 0 {
+		return 0
+	}
+
+	return wb.extents[len(wb.extents)-1].end()
+}
+
+func (wb *writeBuffer) empty() bool {
+	return len(wb.extents) == 0
+}
+
+func (wb *writeBuffer) reset() {
+	wb.extents = nil
+	wb.n = 0
+}
+
+//contentReader streams a file's content as it will be after the buffered
+//writes are committed, it is used to feed the chunker
+type contentReader struct {
+	f    *File
+	tx   *bolt.Tx
+	refs []ChunkRef
+	pos  int64
+	end  int64
+}
+
+func (r *contentReader) Read(p []byte) (n int, err error) {
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.end-r.pos {
+		p = p[:r.end-r.pos]
+	}
+
+	if err = r.f.readCommitted(r.tx, r.refs, r.pos, p); err != nil {
+		return 0, err
+	}
+
+	r.f.open.buf.overlay(r.pos, p)
+	r.pos += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,258 @@
+package datafs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//ErrNoXattr is returned when a file has no extended attribute by the requested name
+	ErrNoXattr = errors.New("No such attribute")
+
+	//BucketNameXattrs refers to the bucket that holds the extended attributes of files
+	BucketNameXattrs = []byte("xattrs")
+)
+
+//xattrInlineSize is the size up to which attribute values are stored in
+//their record, larger values are chunked like file content. On encrypted
+//volumes every value is chunked such that it is sealed like file content.
+const xattrInlineSize = 4 * 1024
+
+//xattr is the record of an extended attribute, its value is either inline
+//or split into chunks
+type xattr struct {
+	Value  []byte     `json:"v,omitempty"`
+	Chunks []ChunkRef `json:"c,omitempty"`
+}
+
+//xattrKey returns the key of attribute 'name' of inode 'ino', all
+//attributes of a file share the inode as prefix
+func xattrKey(ino uint64, name []byte) []byte {
+	return append(inoKey(ino), name...)
+}
+
+//checkXattrName returns ErrInvalidName if 'name' cannot name an attribute,
+//the separators of stream names are excluded such that every attribute is
+//also reachable as an alternate data stream
+func checkXattrName(name []byte) error {
+	if len(name) == 0 || len(name) > 255 || bytes.ContainsAny(name, "/\\:\x00") {
+		return ErrInvalidName
+	}
+
+	return nil
+}
+
+//xattrInode resolves the existing file at joined path 'p'
+func xattrInode(tx *bolt.Tx, p ...[]byte) (ino uint64, err error) {
+	if _, ino, err = resolve(tx, p...); err != nil {
+		return 0, err
+	} else if ino == 0 {
+		return 0, ErrNotExist
+	}
+
+	return ino, nil
+}
+
+//loadXattr returns the record of attribute 'name' of inode 'ino' or nil
+func loadXattr(tx *bolt.Tx, ino uint64, name []byte) (x *xattr, err error) {
+	data := tx.Bucket(BucketNameXattrs).Get(xattrKey(ino, name))
+	if data == nil {
+		return nil, nil
+	}
+
+	x = &xattr{}
+	if err = json.Unmarshal(data, x); err != nil {
+		return nil, fmt.Errorf("failed to deserialize attribute '%s' of inode %d: %v", name, ino, err)
+	}
+
+	return x, nil
+}
+
+//Xattr returns the value of the extended attribute 'name' of the file at
+//joined path 'p'. Windows alternate data streams and POSIX extended
+//attributes share this namespace: the stream 'a.txt:Zone.Identifier' is
+//the attribute 'Zone.Identifier' of 'a.txt'.
+func (fs *FileSystem) Xattr(name []byte, p ...[]byte) (value []byte, err error) {
+	if err = checkXattrName(name); err != nil {
+		return nil, err
+	}
+
+	err = fs.db.View(func(tx *bolt.Tx) error {
+		ino, err := xattrInode(tx, p...)
+		if err != nil {
+			return err
+		}
+
+		x, err := loadXattr(tx, ino, name)
+		if err != nil {
+			return err
+		} else if x == nil {
+			return ErrNoXattr
+		}
+
+		if x.Chunks == nil {
+			value = append([]byte{}, x.Value...)
+			return nil
+		}
+
+		for _, ref := range x.Chunks {
+			c, err := fs.chunks.Get(tx, ref.K)
+			if err != nil {
+				return fmt.Errorf("failed to get chunk of attribute '%s': %v", name, err)
+			}
+
+			value = append(value, c...)
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+//SetXattr stores 'value' as extended attribute 'name' of the file at joined
+//path 'p', replacing a previous value
+func (fs *FileSystem) SetXattr(name, value []byte, p ...[]byte) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		ino, err := xattrInode(tx, p...)
+		if err != nil {
+			return err
+		}
+
+		x := &xattr{Value: append([]byte{}, value...)}
+		if len(value) > xattrInlineSize || fs.chunks.cipher != nil {
+			x.Value = nil
+			chunker, err := NewChunker(bytes.NewReader(value), fs.opts.Chunking)
+			if err != nil {
+				return err
+			}
+
+			var pos int64
+			for {
+				c, err := chunker.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+
+				ref := ChunkRef{Offset: pos, Size: int64(len(c))}
+				if ref.K, err = fs.chunks.Put(tx, c); err != nil {
+					return fmt.Errorf("failed to put chunk of attribute '%s': %v", name, err)
+				}
+
+				x.Chunks = append(x.Chunks, ref)
+				pos += ref.Size
+			}
+		}
+
+		if err = removeXattr(tx, fs.chunks, ino, name); err != nil && err != ErrNoXattr {
+			return err
+		}
+
+		data, err := json.Marshal(x)
+		if err != nil {
+			return fmt.Errorf("failed to serialize attribute '%s': %v", name, err)
+		}
+
+		return tx.Bucket(BucketNameXattrs).Put(xattrKey(ino, name), data)
+	})
+}
+
+//RemoveXattr removes the extended attribute 'name' of the file at joined path 'p'
+func (fs *FileSystem) RemoveXattr(name []byte, p ...[]byte) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		ino, err := xattrInode(tx, p...)
+		if err != nil {
+			return err
+		}
+
+		return removeXattr(tx, fs.chunks, ino, name)
+	})
+}
+
+//Xattrs returns the names of the extended attributes of the file at joined
+//path 'p' in sorted order
+func (fs *FileSystem) Xattrs(p ...[]byte) (names [][]byte, err error) {
+	err = fs.db.View(func(tx *bolt.Tx) error {
+		ino, err := xattrInode(tx, p...)
+		if err != nil {
+			return err
+		}
+
+		prefix := inoKey(ino)
+		c := tx.Bucket(BucketNameXattrs).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			names = append(names, append([]byte{}, k[len(prefix):]...))
+		}
+
+		return nil
+	})
+
+	sort.Slice(names, func(i, j int) bool { return bytes.Compare(names[i], names[j]) < 0 })
+	return names, err
+}
+
+//removeXattr deletes attribute 'name' of inode 'ino' and releases its chunks
+func removeXattr(tx *bolt.Tx, chunks *ChunkStore, ino uint64, name []byte) error {
+	x, err := loadXattr(tx, ino, name)
+	if err != nil {
+		return err
+	} else if x == nil {
+		return ErrNoXattr
+	}
+
+	if err = chunks.Release(tx, chunkKeys(x.Chunks)); err != nil {
+		return fmt.Errorf("failed to release chunks of attribute '%s': %v", name, err)
+	}
+
+	return tx.Bucket(BucketNameXattrs).Delete(xattrKey(ino, name))
+}
+
+//removeXattrs deletes all attributes of inode 'ino' and releases their chunks
+func removeXattrs(tx *bolt.Tx, chunks *ChunkStore, ino uint64) error {
+	prefix := inoKey(ino)
+	var names [][]byte
+	c := tx.Bucket(BucketNameXattrs).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		names = append(names, append([]byte{}, k[len(prefix):]...))
+	}
+
+	for _, name := range names {
+		if err := removeXattr(tx, chunks, ino, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//xattrChunkKeys calls 'ref' for the chunks of all attribute values
+func xattrChunkKeys(tx *bolt.Tx, ref func(k K)) error {
+	return tx.Bucket(BucketNameXattrs).ForEach(func(k, v []byte) error {
+		x := &xattr{}
+		if err := json.Unmarshal(v, x); err != nil {
+			return fmt.Errorf("failed to deserialize attribute %x: %v", k, err)
+		}
+
+		for _, k := range chunkKeys(x.Chunks) {
+			ref(k)
+		}
+
+		return nil
+	})
+}
@@ -1,29 +1,49 @@
 package main
 
 import (
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"time"
 
 	"github.com/advanderveer/datafs/datafs"
 	"github.com/boltdb/bolt"
 	"github.com/keybase/kbfs/dokan"
 )
 
+var (
+	dbPath  = flag.String("db", "", "path to the bolt database that backs the filesystem, a temporary one is mounted if empty")
+	mntPath = flag.String("mount", `T:\`, "path at which the filesystem is mounted")
+	codec   = flag.String("compression", "raw", "codec that compresses new chunks: raw, fast or best")
+	keyFile = flag.String("keyfile", "", "file holding the volume secret, alternatively the passphrase is read from $DATAFS_PASSPHRASE")
+	gcEvery = flag.Duration("gc-interval", 0, "interval at which unreferenced chunks are collected while mounted, e.g. 24h, zero disables it")
+)
+
+//mountAltStream is DOKAN_OPTION_ALT_STREAM, which the dokan package doesn't
+//define. Without it dokan refuses 'file:stream' paths before they reach
+//CreateFile, although the volume reports FileNamedStreams.
+const mountAltStream = dokan.MountFlag(4)
+
 func main() {
 	log.Printf("started")
 	defer log.Printf("exited")
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	flag.Usage = func() {
+		log.Printf("usage: datafs [flags] [gc]")
+		log.Printf("  gc collects unreferenced chunks once, the volume must not be mounted; use -gc-interval to collect while mounted")
+		flag.PrintDefaults()
+	}
 
-	tmpdir, err := ioutil.TempDir("", "datafs_")
-	if err != nil {
-		log.Fatal(err)
+	flag.Parse()
+	if flag.Arg(0) == "gc" && *dbPath == "" {
+		log.Printf("gc requires -db, a temporary database has nothing to collect")
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	db, err := bolt.Open(filepath.Join(tmpdir, "fs.bolt"), 0777, nil)
+	db, err := openDB()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -31,14 +51,61 @@ func main() {
 	log.Printf("using bolt db '%s' as filesystem backend", db.Path())
 	defer db.Close()
 
-	fs, err := datafs.NewBoltFS(db)
+	opts := *datafs.DefaultOptions
+	opts.Compression, err = datafs.ParseCodec(*codec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *keyFile != "" {
+		opts.Secret, err = datafs.ReadKeyFile(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if pass := os.Getenv("DATAFS_PASSPHRASE"); pass != "" {
+		opts.Secret = []byte(pass)
+	}
+
+	logs := log.New(os.Stderr, "datafs/", log.Lshortfile)
+	fs, err := datafs.NewBoltFS(logs, db, &opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+		mount(fs)
+	case "gc":
+		gc(fs)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func openDB() (db *bolt.DB, err error) {
+	path := *dbPath
+	if path == "" {
+		tmpdir, err := ioutil.TempDir("", "datafs_")
+		if err != nil {
+			return nil, err
+		}
+
+		path = filepath.Join(tmpdir, "fs.bolt")
+	}
+
+	//fail instead of blocking when another process holds the database
+	return bolt.Open(path, 0777, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+func mount(fs *datafs.BoltFS) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+
 	conf := &dokan.Config{
 		FileSystem: fs,
-		Path:       `T:\`,
+		Path:       *mntPath,
+		MountFlags: dokan.UseFindFilesWithPattern | mountAltStream,
 	}
 
 	mnt, err := dokan.Mount(conf)
@@ -47,5 +114,45 @@ func main() {
 	}
 
 	defer mnt.Close()
-	<-sigCh
+	if *gcEvery <= 0 {
+		<-sigCh
+		return
+	}
+
+	//bolt locks the database for this process, so collecting while mounted
+	//happens here instead of through the gc mode
+	ticker := time.NewTicker(*gcEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := collect(fs); err != nil {
+				log.Printf("failed to collect garbage: %v", err)
+			}
+		case <-sigCh:
+			return
+		}
+	}
+}
+
+func gc(fs *datafs.BoltFS) {
+	if err := collect(fs); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func collect(fs *datafs.BoltFS) error {
+	st, err := fs.CollectGarbage()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("gc generation %d: %d chunks referenced, %d chunks swept, %d bytes reclaimed", st.Generation, st.Referenced, st.Swept, st.ReclaimedBytes)
+	cs, err := fs.ChunkStats()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d chunks hold %d bytes of file content in %d stored bytes", cs.Chunks, cs.LogicalBytes, cs.PhysicalBytes)
+	return nil
 }